@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/accrualmock"
+)
+
+const defaultRunAddr = ":8081"
+
+// Имитация системы расчета начислений для локальной разработки:
+//
+//	go run ./cmd/accrual-mock -a :8081 -registered 2s -processing 5s -rules 9=INVALID -rate-limit 60
+//	go run ./cmd/gophermart -dev -r http://localhost:8081
+//
+// Адрес берется из ACCRUAL_MOCK_ADDRESS, а не из RUN_ADDRESS, чтобы имитация не заняла порт gophermart,
+// если оба запускаются с одним окружением
+func main() {
+	var (
+		runAddr       string
+		registeredFor time.Duration
+		processingFor time.Duration
+		rules         string
+		rateLimit     int
+		autoRegister  bool
+	)
+	flag.StringVar(&runAddr, "a", defaultRunAddr, "address and port to run accrual mock")
+	flag.DurationVar(&registeredFor, "registered", 2*time.Second, "how long an order stays REGISTERED")
+	flag.DurationVar(&processingFor, "processing", 3*time.Second, "how long an order stays PROCESSING after that")
+	flag.StringVar(&rules, "rules", "", "final results by order number prefix, e.g. 9=INVALID,12=PROCESSED:500; default is PROCESSED with 10 points per digit sum")
+	flag.IntVar(&rateLimit, "rate-limit", 0, "requests per minute before answering 429, 0 - unlimited")
+	flag.BoolVar(&autoRegister, "auto-register", true, "treat every Luhn-valid order as registered on first request, otherwise register with POST /api/orders")
+	flag.Parse()
+
+	if envRunAddr := os.Getenv("ACCRUAL_MOCK_ADDRESS"); envRunAddr != "" {
+		runAddr = envRunAddr
+	}
+
+	parsedRules, err := accrualmock.ParseRules(rules)
+	if err != nil {
+		log.Fatalf("Invalid rules: %v", err)
+	}
+	mock := accrualmock.New(accrualmock.Config{
+		AutoRegister:  autoRegister,
+		RegisteredFor: registeredFor,
+		ProcessingFor: processingFor,
+		Rules:         parsedRules,
+		RateLimit:     rateLimit,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: runAddr, Handler: mock}
+	go func() {
+		log.Printf("Starting accrual mock on %s\n", runAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start accrual mock: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+}
@@ -3,10 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,8 +30,12 @@ import (
 	"github.com/testcontainers/testcontainers-go"
 	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"github.com/theheadmen/goDipl2/internal/accrual"
+	"github.com/theheadmen/goDipl2/internal/accrualmock"
 	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
 	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/oidc"
 	"github.com/theheadmen/goDipl2/internal/server"
 	"github.com/theheadmen/goDipl2/internal/service"
 	"golang.org/x/crypto/bcrypt"
@@ -80,15 +97,8 @@ func (suite *LoyaltySystemTestSuite) SetupSuite() {
 
 	suite.db = db
 
-	suite.ls = server.NewServerSystem(db, "http://localhost:8080")
-	suite.router = mux.NewRouter()
-	suite.router.HandleFunc("/api/user/register", suite.ls.RegisterUserHandler).Methods("POST")
-	suite.router.HandleFunc("/api/user/login", suite.ls.LoginUserHandler).Methods("POST")
-	suite.router.HandleFunc("/api/user/orders", suite.ls.LoadOrderHandler).Methods("POST")
-	suite.router.HandleFunc("/api/user/orders", suite.ls.GetOrderHandler).Methods("GET")
-	suite.router.HandleFunc("/api/user/balance", suite.ls.GetBalanceHandler).Methods("GET")
-	suite.router.HandleFunc("/api/user/balance/withdraw", suite.ls.WithdrawHandler).Methods("POST")
-	suite.router.HandleFunc("/api/user/withdrawals", suite.ls.GetWithdrawalsHandler).Methods("GET")
+	suite.ls = server.NewServerSystem(db, "http://localhost:8080", service.NewTokenManager("test-secret", time.Hour))
+	suite.router = suite.ls.MakeRouter()
 }
 
 func (suite *LoyaltySystemTestSuite) TearDownSuite() {
@@ -111,7 +121,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 	// Test cases
 	testCases := []struct {
 		name                     string
-		cookie                   *http.Cookie
 		orderNumber              string
 		user                     dbconnector.User
 		existingOrder            dbconnector.Order
@@ -122,7 +131,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 	}{
 		{
 			name:                     "Valid order",
-			cookie:                   &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			orderNumber:              "3182649",
 			user:                     dbconnector.User{Email: "test@example.com", Password: "password"},
 			existingOrder:            dbconnector.Order{Number: "3182649"},
@@ -133,7 +141,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 		},
 		{
 			name:                     "Invalid order",
-			cookie:                   &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			orderNumber:              "1",
 			user:                     dbconnector.User{Email: "test@example.com", Password: "password"},
 			existingOrder:            dbconnector.Order{Number: "3182649"},
@@ -144,7 +151,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 		},
 		{
 			name:                     "Repeat order",
-			cookie:                   &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			orderNumber:              "3182649",
 			user:                     dbconnector.User{Email: "test@example.com", Password: "password"},
 			existingOrder:            dbconnector.Order{Number: "3182649"},
@@ -155,7 +161,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 		},
 		{
 			name:                     "Repeat order for another user",
-			cookie:                   &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			orderNumber:              "3182649",
 			user:                     dbconnector.User{Email: "test@example.com", Password: "password"},
 			existingOrder:            dbconnector.Order{Number: "3182649"},
@@ -197,7 +202,7 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoadOrder() {
 			body := []byte(tc.orderNumber)
 			req, err := http.NewRequest("POST", "/api/user/orders", bytes.NewReader(body))
 			require.NoError(t, err)
-			req.AddCookie(tc.cookie)
+			req.AddCookie(suite.sessionCookie(t, tc.user.Email))
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -290,9 +295,20 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemRegister() {
 				resp := rr.Result()
 				defer resp.Body.Close()
 				cookies := resp.Cookies()
+				user, err := suite.db.GetUserByEmail(suite.ctx, tc.firstUser.Email)
+				require.NoError(t, err)
+				// токен для клиентов без cookie приходит в заголовке
+				bearer, token, found := strings.Cut(resp.Header.Get("Authorization"), " ")
+				require.True(t, found)
+				assert.Equal(t, "Bearer", bearer)
+				claims, err := suite.ls.Tokens.Parse(token)
+				require.NoError(t, err)
+				assert.Equal(t, user.ID, claims.UserID)
 				for _, cookie := range cookies {
 					assert.Equal(t, cookie.Name, "session_token")
-					assert.Equal(t, cookie.Value, tc.firstUser.Email)
+					claims, err := suite.ls.Tokens.Parse(cookie.Value)
+					require.NoError(t, err)
+					assert.Equal(t, user.ID, claims.UserID)
 				}
 			}
 
@@ -375,9 +391,20 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLogin() {
 				resp := rr.Result()
 				defer resp.Body.Close()
 				cookies := resp.Cookies()
+				user, err := suite.db.GetUserByEmail(suite.ctx, tc.testUser.Email)
+				require.NoError(t, err)
+				// токен для клиентов без cookie приходит в заголовке
+				bearer, token, found := strings.Cut(resp.Header.Get("Authorization"), " ")
+				require.True(t, found)
+				assert.Equal(t, "Bearer", bearer)
+				claims, err := suite.ls.Tokens.Parse(token)
+				require.NoError(t, err)
+				assert.Equal(t, user.ID, claims.UserID)
 				for _, cookie := range cookies {
 					assert.Equal(t, cookie.Name, "session_token")
-					assert.Equal(t, cookie.Value, tc.testUser.Email)
+					claims, err := suite.ls.Tokens.Parse(cookie.Value)
+					require.NoError(t, err)
+					assert.Equal(t, user.ID, claims.UserID)
 				}
 			}
 
@@ -399,28 +426,24 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetOrder() {
 	// Test cases
 	testCases := []struct {
 		name           string
-		cookie         *http.Cookie
 		user           dbconnector.User
 		orders         []dbconnector.Order
 		expectedStatus int
 	}{
 		{
 			name:           "Valid orders #1",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			orders:         []dbconnector.Order{{Number: "1"}},
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Valid orders #2",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			orders:         []dbconnector.Order{{Number: "1"}, {Number: "2"}},
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Empty orders",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			orders:         []dbconnector.Order{},
 			expectedStatus: http.StatusNoContent,
@@ -448,7 +471,7 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetOrder() {
 			body := []byte{}
 			req, err := http.NewRequest("GET", "/api/user/orders", bytes.NewReader(body))
 			require.NoError(t, err)
-			req.AddCookie(tc.cookie)
+			req.AddCookie(suite.sessionCookie(t, tc.user.Email))
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -488,7 +511,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetBalance() {
 	// Test cases
 	testCases := []struct {
 		name            string
-		cookie          *http.Cookie
 		user            dbconnector.User
 		withdrawals     []dbconnector.Withdrawal
 		balanceResponse models.BalanceResponse
@@ -496,7 +518,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetBalance() {
 	}{
 		{
 			name:            "Valid balance with withdrawal #1",
-			cookie:          &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:            dbconnector.User{Email: "test@example.com", Password: "password", Balance: 100.0},
 			withdrawals:     []dbconnector.Withdrawal{{Points: 100.0, Number: "1"}},
 			balanceResponse: models.BalanceResponse{Current: 100.0, Withdrawn: 100.0},
@@ -504,7 +525,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetBalance() {
 		},
 		{
 			name:            "Valid balance with withdrawal #2",
-			cookie:          &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:            dbconnector.User{Email: "test@example.com", Password: "password", Balance: 50.0},
 			withdrawals:     []dbconnector.Withdrawal{{Points: 100.0, Number: "1"}, {Points: 150.0, Number: "2"}},
 			balanceResponse: models.BalanceResponse{Current: 50.0, Withdrawn: 250.0},
@@ -512,7 +532,6 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetBalance() {
 		},
 		{
 			name:            "Valid balance without withdrawal",
-			cookie:          &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:            dbconnector.User{Email: "test@example.com", Password: "password", Balance: 100.0},
 			withdrawals:     []dbconnector.Withdrawal{},
 			balanceResponse: models.BalanceResponse{Current: 100.0, Withdrawn: 0.0},
@@ -541,7 +560,7 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetBalance() {
 			body := []byte{}
 			req, err := http.NewRequest("GET", "/api/user/balance", bytes.NewReader(body))
 			require.NoError(t, err)
-			req.AddCookie(tc.cookie)
+			req.AddCookie(suite.sessionCookie(t, tc.user.Email))
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -574,21 +593,18 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemWithdrawal() {
 	// Test cases
 	testCases := []struct {
 		name           string
-		cookie         *http.Cookie
 		user           dbconnector.User
 		withdrawal     models.WithdrawRequest
 		expectedStatus int
 	}{
 		{
 			name:           "Valid withdrawal",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password", Balance: 500},
 			withdrawal:     models.WithdrawRequest{Sum: 100.0, Order: "1"},
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Invalid withdrawal",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password", Balance: 500},
 			withdrawal:     models.WithdrawRequest{Sum: 1000.0, Order: "1"},
 			expectedStatus: http.StatusPaymentRequired,
@@ -608,7 +624,7 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemWithdrawal() {
 			require.NoError(t, err)
 			req, err := http.NewRequest("POST", "/api/user/balance/withdraw", bytes.NewReader(body))
 			require.NoError(t, err)
-			req.AddCookie(tc.cookie)
+			req.AddCookie(suite.sessionCookie(t, tc.user.Email))
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -636,28 +652,24 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetWithdrawal() {
 	// Test cases
 	testCases := []struct {
 		name           string
-		cookie         *http.Cookie
 		user           dbconnector.User
 		withdrawals    []dbconnector.Withdrawal
 		expectedStatus int
 	}{
 		{
 			name:           "Valid withdrawal #1",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			withdrawals:    []dbconnector.Withdrawal{{Points: 100.0, UserID: 1, Number: "1"}},
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Valid withdrawal #2",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			withdrawals:    []dbconnector.Withdrawal{{Points: 100.0, Number: "1"}, {Points: 200.0, Number: "2"}},
 			expectedStatus: http.StatusOK,
 		},
 		{
 			name:           "Empty withdrawal",
-			cookie:         &http.Cookie{Name: "session_token", Value: "test@example.com"},
 			user:           dbconnector.User{Email: "test@example.com", Password: "password"},
 			withdrawals:    []dbconnector.Withdrawal{},
 			expectedStatus: http.StatusNoContent,
@@ -685,7 +697,7 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetWithdrawal() {
 			body := []byte{}
 			req, err := http.NewRequest("GET", "/api/user/withdrawals", bytes.NewReader(body))
 			require.NoError(t, err)
-			req.AddCookie(tc.cookie)
+			req.AddCookie(suite.sessionCookie(t, tc.user.Email))
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -713,6 +725,2273 @@ func (suite *LoyaltySystemTestSuite) TestLoyaltySystemGetWithdrawal() {
 	}
 }
 
+// AuthenticateUser
+// валидный токен, http.StatusOK
+// токен без подписи (старый формат с email), http.StatusUnauthorized
+// токен с подделанной подписью, http.StatusUnauthorized
+// просроченный токен, http.StatusUnauthorized
+// токен отозванной сессии, http.StatusUnauthorized
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemSessionToken() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(suite.T(), err)
+
+	validToken := suite.sessionCookie(suite.T(), user.Email).Value
+	claims, err := suite.ls.Tokens.Parse(validToken)
+	require.NoError(suite.T(), err)
+	forgedToken, err := service.NewTokenManager("other-secret", time.Hour).Issue(user.ID, claims.SessionID)
+	require.NoError(suite.T(), err)
+	expiredToken, err := service.NewTokenManager("test-secret", -time.Minute).Issue(user.ID, claims.SessionID)
+	require.NoError(suite.T(), err)
+	revokedToken := suite.sessionCookie(suite.T(), user.Email).Value
+	revokedClaims, err := suite.ls.Tokens.Parse(revokedToken)
+	require.NoError(suite.T(), err)
+	err = suite.db.RevokeSession(suite.ctx, revokedClaims.SessionID, user.ID)
+	require.NoError(suite.T(), err)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		token          string
+		useBearer      bool
+		expectedStatus int
+	}{
+		{
+			name:           "Valid token",
+			token:          validToken,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Valid bearer token",
+			token:          validToken,
+			useBearer:      true,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Forged bearer token",
+			token:          forgedToken,
+			useBearer:      true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Raw email",
+			token:          user.Email,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Forged token",
+			token:          forgedToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Expired token",
+			token:          expiredToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Revoked session",
+			token:          revokedToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		suite.T().Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/api/user/balance", nil)
+			require.NoError(t, err)
+			if tc.useBearer {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			} else {
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: tc.token})
+			}
+
+			rr := httptest.NewRecorder()
+			suite.router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+		})
+	}
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Sessions
+// в списке видны все сессии пользователя, текущая помечена
+// удаленная сессия пропадает из списка и больше не пускает, http.StatusUnauthorized
+// чужую сессию удалить нельзя, http.StatusNotFound
+// после logout текущая сессия больше не пускает, http.StatusUnauthorized
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemSessions() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	otherUser := dbconnector.User{Email: "test2@example.com", Password: "password"}
+	err = suite.db.AddUser(suite.ctx, &otherUser)
+	require.NoError(t, err)
+
+	currentCookie := suite.sessionCookie(t, user.Email)
+	secondCookie := suite.sessionCookie(t, user.Email)
+	secondClaims, err := suite.ls.Tokens.Parse(secondCookie.Value)
+	require.NoError(t, err)
+	otherClaims, err := suite.ls.Tokens.Parse(suite.sessionCookie(t, otherUser.Email).Value)
+	require.NoError(t, err)
+
+	// Смотрим список сессий
+	req, err := http.NewRequest("GET", "/api/user/sessions", nil)
+	require.NoError(t, err)
+	req.AddCookie(currentCookie)
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sessionResponses []models.SessionResponse
+	err = json.NewDecoder(rr.Body).Decode(&sessionResponses)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sessionResponses))
+	assert.True(t, sessionResponses[0].Current)
+	assert.False(t, sessionResponses[1].Current)
+
+	// Чужую сессию удалить нельзя
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("/api/user/sessions/%d", otherClaims.SessionID), nil)
+	require.NoError(t, err)
+	req.AddCookie(currentCookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Удаляем вторую сессию
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("/api/user/sessions/%d", secondClaims.SessionID), nil)
+	require.NoError(t, err)
+	req.AddCookie(currentCookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, err = http.NewRequest("GET", "/api/user/balance", nil)
+	require.NoError(t, err)
+	req.AddCookie(secondCookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Выходим из текущей сессии
+	req, err = http.NewRequest("POST", "/api/user/logout", nil)
+	require.NoError(t, err)
+	req.AddCookie(currentCookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	req, err = http.NewRequest("GET", "/api/user/balance", nil)
+	require.NoError(t, err)
+	req.AddCookie(currentCookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// ChangePasswordHandler
+// успешная смена пароля, http.StatusOK, другие сессии отозваны, текущая работает
+// неправильный текущий пароль, http.StatusUnauthorized
+// пустой новый пароль, http.StatusBadRequest
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemChangePassword() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		password       string
+		changeRequest  models.ChangePasswordRequest
+		expectedStatus int
+	}{
+		{
+			name:           "Valid change",
+			password:       "password",
+			changeRequest:  models.ChangePasswordRequest{CurrentPassword: "password", NewPassword: "new-password"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Invalid change, wrong current password",
+			password:       "password",
+			changeRequest:  models.ChangePasswordRequest{CurrentPassword: "password23", NewPassword: "new-password"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Invalid change, no new password",
+			password:       "password",
+			changeRequest:  models.ChangePasswordRequest{CurrentPassword: "password", NewPassword: ""},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		suite.T().Run(tc.name, func(t *testing.T) {
+			// Перестраховка на всякий случай
+			suite.db.DeleteAllData(suite.ctx)
+			// Setup database with test data
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(tc.password), bcrypt.DefaultCost)
+			require.NoError(t, err)
+			user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword)}
+			err = suite.db.AddUser(suite.ctx, &user)
+			require.NoError(t, err)
+			currentCookie := suite.sessionCookie(t, user.Email)
+			otherCookie := suite.sessionCookie(t, user.Email)
+
+			// Create request
+			body, err := json.Marshal(tc.changeRequest)
+			require.NoError(t, err)
+			req, err := http.NewRequest("POST", "/api/user/password", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.AddCookie(currentCookie)
+
+			rr := httptest.NewRecorder()
+			suite.router.ServeHTTP(rr, req)
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+
+			// при успешной смене другая сессия должна быть отозвана, а текущая продолжает работать
+			expectedOtherStatus := http.StatusOK
+			if tc.expectedStatus == http.StatusOK {
+				expectedOtherStatus = http.StatusUnauthorized
+			}
+			for cookie, expectedStatus := range map[*http.Cookie]int{currentCookie: http.StatusOK, otherCookie: expectedOtherStatus} {
+				req, err = http.NewRequest("GET", "/api/user/balance", nil)
+				require.NoError(t, err)
+				req.AddCookie(cookie)
+				rr = httptest.NewRecorder()
+				suite.router.ServeHTTP(rr, req)
+				assert.Equal(t, expectedStatus, rr.Code)
+			}
+
+			// в базе лежит хеш того пароля, который теперь действует
+			storedUser, err := suite.db.GetUserByEmail(suite.ctx, user.Email)
+			require.NoError(t, err)
+			actualPassword := tc.password
+			if tc.expectedStatus == http.StatusOK {
+				actualPassword = tc.changeRequest.NewPassword
+			}
+			assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(actualPassword)))
+
+			// Clean up test data
+			suite.db.DeleteAllData(suite.ctx)
+		})
+	}
+}
+
+// RequestPasswordResetHandler, ConfirmPasswordResetHandler
+// неизвестный логин, http.StatusAccepted, письмо не отправлено
+// сброс по токену из письма, http.StatusOK, старые сессии отозваны, новый пароль работает
+// повторное использование токена, http.StatusBadRequest
+// просроченный токен, http.StatusBadRequest
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemPasswordReset() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	mail := &testMailer{}
+	defaultMailer, defaultTTL := suite.ls.Mailer, suite.ls.ResetTokenTTL
+	suite.ls.Mailer = mail
+	defer func() {
+		suite.ls.Mailer, suite.ls.ResetTokenTTL = defaultMailer, defaultTTL
+	}()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	oldCookie := suite.sessionCookie(t, user.Email)
+
+	post := func(url string, payload interface{}) int {
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Для неизвестного логина отвечаем так же, но письмо не шлем
+	code := post("/api/user/password/reset", models.PasswordResetRequest{Login: "unknown@example.com"})
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, 0, len(mail.bodies))
+
+	code = post("/api/user/password/reset", models.PasswordResetRequest{Login: user.Email})
+	assert.Equal(t, http.StatusAccepted, code)
+	require.Equal(t, 1, len(mail.bodies))
+	token := resetTokenRegexp.FindStringSubmatch(mail.bodies[0])
+	require.Equal(t, 2, len(token))
+
+	// Пароль, совпадающий с логином, отклоняется, но токен при этом не сгорает
+	code = post("/api/user/password/reset/confirm", models.PasswordResetConfirmRequest{Token: token[1], Password: user.Email})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code = post("/api/user/password/reset/confirm", models.PasswordResetConfirmRequest{Token: token[1], Password: "new-password"})
+	assert.Equal(t, http.StatusOK, code)
+
+	// Старая сессия больше не работает, а войти можно с новым паролем
+	req, err := http.NewRequest("GET", "/api/user/balance", nil)
+	require.NoError(t, err)
+	req.AddCookie(oldCookie)
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	code = post("/api/user/login", dbconnector.User{Email: user.Email, Password: "new-password"})
+	assert.Equal(t, http.StatusOK, code)
+
+	// Токен одноразовый
+	code = post("/api/user/password/reset/confirm", models.PasswordResetConfirmRequest{Token: token[1], Password: "other-password"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Просроченный токен не принимается
+	suite.ls.ResetTokenTTL = -time.Minute
+	code = post("/api/user/password/reset", models.PasswordResetRequest{Login: user.Email})
+	assert.Equal(t, http.StatusAccepted, code)
+	require.Equal(t, 2, len(mail.bodies))
+	token = resetTokenRegexp.FindStringSubmatch(mail.bodies[1])
+	require.Equal(t, 2, len(token))
+	code = post("/api/user/password/reset/confirm", models.PasswordResetConfirmRequest{Token: token[1], Password: "other-password"})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// LoginUserHandler, защита от подбора
+// после MaxLoginFailures неудач даже верный пароль получает http.StatusTooManyRequests с Retry-After
+// после MaxIPFailures неудач с одного IP блокируется этот IP, но не другие
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemLoginLockout() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	defaultLockout := suite.ls.Lockout
+	suite.ls.Lockout = service.LockoutPolicy{MaxLoginFailures: 3, MaxIPFailures: 5, LockoutDuration: time.Minute, MaxLockout: time.Hour}
+	defer func() {
+		suite.ls.Lockout = defaultLockout
+	}()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	for _, email := range []string{"test@example.com", "test2@example.com"} {
+		user := dbconnector.User{Email: email, Password: string(hashedPassword)}
+		err = suite.db.AddUser(suite.ctx, &user)
+		require.NoError(t, err)
+	}
+
+	login := func(email string, password string, remoteAddr string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(dbconnector.User{Email: email, Password: password})
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", "/api/user/login", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Подбираем пароль к одному логину с разных адресов
+	for i := 0; i < 3; i++ {
+		rr := login("test@example.com", "password23", fmt.Sprintf("10.0.1.%d:1234", i))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+	rr := login("test@example.com", "password", "10.0.1.100:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60)
+
+	// Перебираем логины с одного адреса
+	for i := 0; i < 5; i++ {
+		rr := login(fmt.Sprintf("unknown%d@example.com", i), "password", "10.0.2.1:1234")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+	rr = login("test2@example.com", "password", "10.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	rr = login("test2@example.com", "password", "10.0.2.2:1234")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// TOTP
+// подключение: неверный первый код http.StatusForbidden, верный включает 2FA и выдает резервные коды
+// вход: пароль дает http.StatusAccepted и mfa_token, сессия только после кода, резервный код одноразовый
+// крупное списание без кода http.StatusForbidden, со свежим кодом http.StatusOK, повтор кода http.StatusForbidden
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemTOTP() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	defaultThreshold := suite.ls.WithdrawTOTPThreshold
+	suite.ls.WithdrawTOTPThreshold = 100
+	defer func() {
+		suite.ls.WithdrawTOTPThreshold = defaultThreshold
+	}()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword), Balance: 500}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	cookie := suite.sessionCookie(t, user.Email)
+
+	do := func(method string, url string, payload interface{}, cookie *http.Cookie) *httptest.ResponseRecorder {
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Подключаем второй фактор
+	rr := do("POST", "/api/user/2fa/enroll", nil, cookie)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var enrollResponse models.TOTPEnrollResponse
+	err = json.NewDecoder(rr.Body).Decode(&enrollResponse)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enrollResponse.OTPAuthURI, "otpauth://totp/"))
+	assert.Contains(t, enrollResponse.OTPAuthURI, "secret="+enrollResponse.Secret)
+
+	rr = do("POST", "/api/user/2fa/confirm", models.TOTPCodeRequest{Code: "abcdef"}, cookie)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// каждый код одноразовый, поэтому дальше берем коды из соседних интервалов
+	now := time.Now()
+	code, err := service.TOTPCode(enrollResponse.Secret, now.Add(-30*time.Second))
+	require.NoError(t, err)
+	rr = do("POST", "/api/user/2fa/confirm", models.TOTPCodeRequest{Code: code}, cookie)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var confirmResponse models.TOTPConfirmResponse
+	err = json.NewDecoder(rr.Body).Decode(&confirmResponse)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(confirmResponse.RecoveryCodes))
+
+	// Вход в два шага
+	rr = do("POST", "/api/user/login", dbconnector.User{Email: user.Email, Password: "password"}, nil)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+	var mfaResponse models.MFARequiredResponse
+	err = json.NewDecoder(rr.Body).Decode(&mfaResponse)
+	require.NoError(t, err)
+	assert.True(t, mfaResponse.MFARequired)
+
+	rr = do("POST", "/api/user/login/2fa", models.MFALoginRequest{MFAToken: mfaResponse.MFAToken, Code: "abcdef"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = do("POST", "/api/user/login/2fa", models.MFALoginRequest{MFAToken: mfaResponse.MFAToken, Code: confirmResponse.RecoveryCodes[0]}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Authorization"))
+
+	rr = do("POST", "/api/user/login/2fa", models.MFALoginRequest{MFAToken: mfaResponse.MFAToken, Code: confirmResponse.RecoveryCodes[0]}, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// mfa_token не годится как токен сессии
+	req, err := http.NewRequest("GET", "/api/user/balance", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+mfaResponse.MFAToken)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Крупное списание требует свежий код
+	rr = do("POST", "/api/user/balance/withdraw", models.WithdrawRequest{Order: "1", Sum: 200}, cookie)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	code, err = service.TOTPCode(enrollResponse.Secret, now)
+	require.NoError(t, err)
+	rr = do("POST", "/api/user/balance/withdraw", models.WithdrawRequest{Order: "1", Sum: 200, TOTPCode: code}, cookie)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = do("POST", "/api/user/balance/withdraw", models.WithdrawRequest{Order: "2", Sum: 200, TOTPCode: code}, cookie)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Мелкое списание проходит без кода
+	rr = do("POST", "/api/user/balance/withdraw", models.WithdrawRequest{Order: "3", Sum: 50}, cookie)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// API ключи
+// создание с неизвестным scope, http.StatusBadRequest
+// ключ пускает только в ручки со своими scope, остальные http.StatusForbidden
+// ручки без scope (управление сессиями) ключ не пускают, http.StatusUnauthorized
+// отозванный и просроченный ключ, http.StatusUnauthorized
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAPIKeys() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password", Balance: 500}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	cookie := suite.sessionCookie(t, user.Email)
+
+	createKey := func(keyRequest models.APIKeyRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(keyRequest)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", "/api/user/apikeys", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+	withKey := func(method string, url string, body []byte, key string) int {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	rr := createKey(models.APIKeyRequest{Name: "pos", Scopes: []string{"orders:delete"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = createKey(models.APIKeyRequest{Name: "pos", Scopes: []string{service.ScopeOrdersWrite, service.ScopeBalanceRead}})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var keyResponse models.APIKeyResponse
+	err = json.NewDecoder(rr.Body).Decode(&keyResponse)
+	require.NoError(t, err)
+	require.NotEmpty(t, keyResponse.Key)
+	assert.True(t, strings.HasPrefix(keyResponse.Key, keyResponse.Prefix))
+
+	assert.Equal(t, http.StatusAccepted, withKey("POST", "/api/user/orders", []byte("3182649"), keyResponse.Key))
+	assert.Equal(t, http.StatusOK, withKey("GET", "/api/user/balance", nil, keyResponse.Key))
+	assert.Equal(t, http.StatusForbidden, withKey("GET", "/api/user/orders", nil, keyResponse.Key))
+	withdrawBody, err := json.Marshal(models.WithdrawRequest{Order: "1", Sum: 100})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, withKey("POST", "/api/user/balance/withdraw", withdrawBody, keyResponse.Key))
+	assert.Equal(t, http.StatusUnauthorized, withKey("GET", "/api/user/sessions", nil, keyResponse.Key))
+	assert.Equal(t, http.StatusUnauthorized, withKey("GET", "/api/user/balance", nil, keyResponse.Key+"0"))
+
+	// В списке ключ виден только по префиксу
+	req, err := http.NewRequest("GET", "/api/user/apikeys", nil)
+	require.NoError(t, err)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var keyResponses []models.APIKeyResponse
+	err = json.NewDecoder(rr.Body).Decode(&keyResponses)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(keyResponses))
+	assert.Empty(t, keyResponses[0].Key)
+	assert.Equal(t, keyResponse.Prefix, keyResponses[0].Prefix)
+
+	// Отзываем ключ
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("/api/user/apikeys/%d", keyResponse.ID), nil)
+	require.NoError(t, err)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, withKey("GET", "/api/user/balance", nil, keyResponse.Key))
+
+	// Просроченный ключ
+	rr = createKey(models.APIKeyRequest{Name: "expired", Scopes: []string{service.ScopeBalanceRead}})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	err = json.NewDecoder(rr.Body).Decode(&keyResponse)
+	require.NoError(t, err)
+	expiredAt := time.Now().Add(-time.Minute)
+	err = suite.db.DB.Model(&dbconnector.APIKey{}).Where("id = ?", keyResponse.ID).Update("expires_at", expiredAt).Error
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, withKey("GET", "/api/user/balance", nil, keyResponse.Key))
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAdmin() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password", Balance: 500}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	userCookie := suite.sessionCookie(t, user.Email)
+
+	// Первый админ заводится из конфига, повторный вызов ничего не ломает
+	logicSystem := service.LogicSystem{Ctx: suite.ctx, Storage: suite.db}
+	require.NoError(t, logicSystem.SeedAdminLogic("admin@example.com", "adminpassword", suite.ls.Passwords))
+	require.NoError(t, logicSystem.SeedAdminLogic("admin@example.com", "", suite.ls.Passwords))
+	admin, err := suite.db.GetUserByEmail(suite.ctx, "admin@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, service.RoleAdmin, admin.Role)
+	adminCookie := suite.sessionCookie(t, admin.Email)
+
+	doRequest := func(method string, url string, body []byte, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+	sessionsURL := fmt.Sprintf("/api/admin/users/%d/sessions", user.ID)
+
+	// Обычному пользователю админские ручки недоступны
+	assert.Equal(t, http.StatusUnauthorized, doRequest("GET", sessionsURL, nil, nil).Code)
+	assert.Equal(t, http.StatusForbidden, doRequest("GET", sessionsURL, nil, userCookie).Code)
+
+	rr := doRequest("GET", sessionsURL, nil, adminCookie)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sessionResponses []models.SessionResponse
+	err = json.NewDecoder(rr.Body).Decode(&sessionResponses)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sessionResponses))
+
+	// Админ убивает все сессии пользователя
+	assert.Equal(t, http.StatusOK, doRequest("DELETE", sessionsURL, nil, adminCookie).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest("GET", "/api/user/balance", nil, userCookie).Code)
+	assert.Equal(t, http.StatusOK, doRequest("GET", "/api/user/balance", nil, adminCookie).Code)
+
+	// Админ выпускает ключ пользователю и отзывает его
+	apiKeysURL := fmt.Sprintf("/api/admin/users/%d/apikeys", user.ID)
+	body, err := json.Marshal(models.APIKeyRequest{Name: "integration", Scopes: []string{service.ScopeBalanceRead}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, doRequest("POST", apiKeysURL, body, suite.sessionCookie(t, user.Email)).Code)
+	rr = doRequest("POST", apiKeysURL, body, adminCookie)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var keyResponse models.APIKeyResponse
+	err = json.NewDecoder(rr.Body).Decode(&keyResponse)
+	require.NoError(t, err)
+	withKey := func(key string) int {
+		req, err := http.NewRequest("GET", "/api/user/balance", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, withKey(keyResponse.Key))
+	keys, err := suite.db.GetAPIKeysByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, keyResponse.ID, keys[0].ID)
+	assert.Equal(t, http.StatusOK, doRequest("DELETE", fmt.Sprintf("%s/%d", apiKeysURL, keyResponse.ID), nil, adminCookie).Code)
+	assert.Equal(t, http.StatusUnauthorized, withKey(keyResponse.Key))
+
+	// Смена роли
+	roleURL := fmt.Sprintf("/api/admin/users/%d/role", user.ID)
+	body, err = json.Marshal(models.RoleRequest{Role: "root"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, doRequest("PUT", roleURL, body, adminCookie).Code)
+	body, err = json.Marshal(models.RoleRequest{Role: service.RoleAdmin})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, doRequest("PUT", "/api/admin/users/999999/role", body, adminCookie).Code)
+	assert.Equal(t, http.StatusOK, doRequest("PUT", roleURL, body, adminCookie).Code)
+	assert.Equal(t, http.StatusOK, doRequest("GET", sessionsURL, nil, suite.sessionCookie(t, user.Email)).Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// RegisterUserHandler, LoginUserHandler с политикой паролей
+// короткий пароль, пароль равен логину, пароль из запрещенного списка - http.StatusBadRequest
+// при входе хеш со старой стоимостью перехешируется с новой
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemPasswordPolicy() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	defaultPolicy := suite.ls.Passwords
+	suite.ls.Passwords = service.PasswordPolicy{
+		Cost:      bcrypt.MinCost + 1,
+		MinLength: 8,
+		DenyList:  map[string]bool{"qwerty123": true},
+	}
+	defer func() { suite.ls.Passwords = defaultPolicy }()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		user           dbconnector.User
+		expectedStatus int
+	}{
+		{
+			name:           "Valid password",
+			user:           dbconnector.User{Email: "test@example.com", Password: "long-enough-password"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Too short password",
+			user:           dbconnector.User{Email: "test@example.com", Password: "short"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Password equals login",
+			user:           dbconnector.User{Email: "test@example.com", Password: "TEST@example.com"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Denied password",
+			user:           dbconnector.User{Email: "test@example.com", Password: "QWERTY123"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		suite.T().Run(tc.name, func(t *testing.T) {
+			// Перестраховка на всякий случай
+			suite.db.DeleteAllData(suite.ctx)
+
+			body, err := json.Marshal(tc.user)
+			require.NoError(t, err)
+			req, err := http.NewRequest("POST", "/api/user/register", bytes.NewReader(body))
+			require.NoError(t, err)
+			rr := httptest.NewRecorder()
+			suite.router.ServeHTTP(rr, req)
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+
+			// Clean up test data
+			suite.db.DeleteAllData(suite.ctx)
+		})
+	}
+
+	t := suite.T()
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("old-cost-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+
+	body, err := json.Marshal(dbconnector.User{Email: user.Email, Password: "old-cost-password"})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/api/user/login", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	storedUser, err := suite.db.GetUserByEmail(suite.ctx, user.Email)
+	require.NoError(t, err)
+	cost, err := bcrypt.Cost([]byte(storedUser.Password))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost+1, cost)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte("old-cost-password")))
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// RegisterUserHandler с подтверждением почты, ConfirmEmailHandler, ResendEmailVerificationHandler
+// неподтвержденный пользователь загружает заказы, но не списывает баллы
+// после подтверждения по токену из письма списание работает, токен одноразовый
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemEmailVerification() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+	mail := &testMailer{}
+	defaultMailer := suite.ls.Mailer
+	suite.ls.Mailer = mail
+	suite.ls.EmailVerification = true
+	defer func() {
+		suite.ls.Mailer = defaultMailer
+		suite.ls.EmailVerification = false
+	}()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+
+	doRequest := func(method string, url string, body []byte, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	body, err := json.Marshal(dbconnector.User{Email: "test@example.com", Password: "password"})
+	require.NoError(t, err)
+	rr := doRequest("POST", "/api/user/register", body, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, 1, len(mail.bodies))
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "session_token" {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie)
+
+	// баллы начисляем напрямую, чтобы было что списывать
+	user, err := suite.db.GetUserByEmail(suite.ctx, "test@example.com")
+	require.NoError(t, err)
+	assert.True(t, user.EmailUnverified)
+	require.NoError(t, suite.db.DB.Model(&dbconnector.User{}).Where("id = ?", user.ID).Update("balance", 500).Error)
+
+	assert.Equal(t, http.StatusAccepted, doRequest("POST", "/api/user/orders", []byte("3182649"), cookie).Code)
+	withdrawBody, err := json.Marshal(models.WithdrawRequest{Order: "2377225624", Sum: 100})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, doRequest("POST", "/api/user/balance/withdraw", withdrawBody, cookie).Code)
+
+	// Повторное письмо с новым токеном
+	assert.Equal(t, http.StatusAccepted, doRequest("POST", "/api/user/email/resend", nil, cookie).Code)
+	require.Equal(t, 2, len(mail.bodies))
+	token := verificationTokenRegexp.FindStringSubmatch(mail.bodies[1])
+	require.Equal(t, 2, len(token))
+
+	body, err = json.Marshal(models.EmailConfirmRequest{Token: "wrong"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, doRequest("POST", "/api/user/email/confirm", body, nil).Code)
+	body, err = json.Marshal(models.EmailConfirmRequest{Token: token[1]})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, doRequest("POST", "/api/user/email/confirm", body, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest("POST", "/api/user/email/confirm", body, nil).Code)
+
+	assert.Equal(t, http.StatusOK, doRequest("POST", "/api/user/balance/withdraw", withdrawBody, cookie).Code)
+	assert.Equal(t, http.StatusConflict, doRequest("POST", "/api/user/email/resend", nil, cookie).Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// OIDCLoginHandler, OIDCCallbackHandler против локального мок-провайдера
+// новый пользователь заводится по subject, повторный вход находит его же
+// существующий пользователь привязывается по подтвержденной почте
+// подмененный state и id_token с чужой подписью не принимаются
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemOIDC() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	provider := newMockOIDCProvider(t)
+	defer provider.server.Close()
+	oidcProvider, err := oidc.NewProvider(suite.ctx, provider.server.URL, "gophermart", "client-secret", "http://localhost:8080/api/user/oidc/callback")
+	require.NoError(t, err)
+	suite.ls.OIDC = oidcProvider
+	defer func() { suite.ls.OIDC = nil }()
+	router := suite.ls.MakeRouter()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	existingUser := dbconnector.User{Email: "linked@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &existingUser)
+	require.NoError(t, err)
+
+	// login отдает редирект на провайдера и cookie со state, callback получает code как от провайдера
+	ssoLogin := func(changeState bool) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/user/oidc/login", nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusFound, rr.Code)
+		location, err := url.Parse(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(location.String(), provider.server.URL+"/authorize"))
+		provider.nonce = location.Query().Get("nonce")
+
+		state := location.Query().Get("state")
+		if changeState {
+			state = "forged"
+		}
+		callbackURL := "/api/user/oidc/callback?" + url.Values{"code": {"auth-code"}, "state": {state}}.Encode()
+		req, err = http.NewRequest("GET", callbackURL, nil)
+		require.NoError(t, err)
+		for _, cookie := range rr.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Новый пользователь
+	provider.subject, provider.email, provider.emailVerified = "sso-user-1", "new@example.com", true
+	rr := ssoLogin(false)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Header().Get("Authorization"), "Bearer "))
+	newUser, err := suite.db.GetUserByOIDCSubject(suite.ctx, "sso-user-1")
+	require.NoError(t, err)
+	assert.Equal(t, "new@example.com", newUser.Email)
+
+	rr = ssoLogin(false)
+	require.Equal(t, http.StatusOK, rr.Code)
+	sameUser, err := suite.db.GetUserByOIDCSubject(suite.ctx, "sso-user-1")
+	require.NoError(t, err)
+	assert.Equal(t, newUser.ID, sameUser.ID)
+
+	// Неподтвержденную почту не привязываем к существующему аккаунту
+	provider.subject, provider.email, provider.emailVerified = "sso-user-2", existingUser.Email, false
+	assert.Equal(t, http.StatusConflict, ssoLogin(false).Code)
+
+	provider.emailVerified = true
+	require.Equal(t, http.StatusOK, ssoLogin(false).Code)
+	linkedUser, err := suite.db.GetUserByOIDCSubject(suite.ctx, "sso-user-2")
+	require.NoError(t, err)
+	assert.Equal(t, existingUser.ID, linkedUser.ID)
+
+	assert.Equal(t, http.StatusBadRequest, ssoLogin(true).Code)
+
+	// id_token, подписанный не ключом провайдера
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider.signingKey = otherKey
+	assert.Equal(t, http.StatusUnauthorized, ssoLogin(false).Code)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Проверка id_token с неизвестным kid
+// JWKS перечитывается не чаще раза в минуту, поддельные токены отклоняются без запроса к провайдеру
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemOIDCUnknownKey() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	provider := newMockOIDCProvider(t)
+	defer provider.server.Close()
+	oidcProvider, err := oidc.NewProvider(suite.ctx, provider.server.URL, "gophermart", "client-secret", "http://localhost:8080/api/user/oidc/callback")
+	require.NoError(t, err)
+	provider.subject, provider.nonce = "sso-subject", "nonce"
+
+	identity, err := oidcProvider.Verify(suite.ctx, provider.idToken(t), "nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "sso-subject", identity.Subject)
+	require.Equal(t, int32(1), provider.jwksHits.Load())
+
+	provider.kid = "forged-key"
+	for i := 0; i < 5; i++ {
+		_, err = oidcProvider.Verify(suite.ctx, provider.idToken(t), "nonce")
+		assert.ErrorIs(t, err, errors.ErrUnknownOIDCKey)
+	}
+	assert.Equal(t, int32(1), provider.jwksHits.Load())
+
+	// известный ключ по-прежнему принимается из кеша
+	provider.kid = "test-key"
+	_, err = oidcProvider.Verify(suite.ctx, provider.idToken(t), "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), provider.jwksHits.Load())
+}
+
+// GetSecurityEventsHandler
+// неудачный и удачный вход и новая сессия попадают в журнал, новые события первыми
+// постраничный вывод через limit и offset, некорректный limit - http.StatusBadRequest
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemSecurityEvents() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+
+	login := func(password string, userAgent string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(dbconnector.User{Email: user.Email, Password: password})
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", "/api/user/login", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "203.0.113.7:51000"
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr
+	}
+	getEvents := func(query string, authorization string) ([]models.SecurityEventResponse, int) {
+		req, err := http.NewRequest("GET", "/api/user/security/events"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		var events []models.SecurityEventResponse
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&events))
+		}
+		return events, rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password", "attacker").Code)
+	rr := login("password", "mobile-app")
+	require.Equal(t, http.StatusOK, rr.Code)
+	authorization := rr.Header().Get("Authorization")
+
+	events, code := getEvents("", authorization)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 3, len(events))
+	assert.Equal(t, service.SecurityEventSessionCreated, events[0].Type)
+	assert.Equal(t, service.SecurityEventLogin, events[1].Type)
+	assert.True(t, events[1].Success)
+	assert.Equal(t, "mobile-app", events[1].UserAgent)
+	assert.Equal(t, service.SecurityEventLogin, events[2].Type)
+	assert.False(t, events[2].Success)
+	assert.Equal(t, "attacker", events[2].UserAgent)
+	assert.Equal(t, "203.0.113.7", events[2].IP)
+
+	events, code = getEvents("?limit=1&offset=1", authorization)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, len(events))
+	assert.True(t, events[0].Success)
+	assert.Equal(t, service.SecurityEventLogin, events[0].Type)
+
+	_, code = getEvents("?limit=abc", authorization)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Чужие события не видны
+	otherUser := dbconnector.User{Email: "other@example.com", Password: "password"}
+	err = suite.db.AddUser(suite.ctx, &otherUser)
+	require.NoError(t, err)
+	otherCookie := suite.sessionCookie(t, otherUser.Email)
+	events, code = getEvents("", "Bearer "+otherCookie.Value)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, service.SecurityEventSessionCreated, events[0].Type)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// ExportUserDataHandler, DeleteAccountHandler
+// выгрузка содержит профиль, заказы, списания и журнал
+// удаление с неверным паролем - http.StatusUnauthorized, с верным - пользователь обезличен,
+// сессии отозваны, войти нельзя, заказы и списания остались
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccountExportAndDelete() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword), Balance: 500}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	order := dbconnector.Order{Number: "3182649", UserID: user.ID, Status: "PROCESSED", Points: 500}
+	err = suite.db.AddOrder(suite.ctx, &order)
+	require.NoError(t, err)
+	withdrawal := dbconnector.Withdrawal{Number: "2377225624", UserID: user.ID, Points: 100}
+	err = suite.db.AddWithdrawal(suite.ctx, &withdrawal)
+	require.NoError(t, err)
+	cookie := suite.sessionCookie(t, user.Email)
+
+	req, err := http.NewRequest("GET", "/api/user/export", nil)
+	require.NoError(t, err)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var export models.UserExport
+	err = json.NewDecoder(rr.Body).Decode(&export)
+	require.NoError(t, err)
+	assert.Equal(t, user.Email, export.Profile.Login)
+	assert.Equal(t, 500.0, export.Profile.Balance)
+	require.Equal(t, 1, len(export.Orders))
+	assert.Equal(t, order.Number, export.Orders[0].Number)
+	require.Equal(t, 1, len(export.Withdrawals))
+	assert.Equal(t, withdrawal.Number, export.Withdrawals[0].Order)
+	require.Equal(t, 1, len(export.Sessions))
+	assert.True(t, export.Sessions[0].Current)
+	require.Equal(t, 1, len(export.SecurityEvents))
+
+	deleteAccount := func(password string) int {
+		body, err := json.Marshal(models.DeleteAccountRequest{Password: password})
+		require.NoError(t, err)
+		req, err := http.NewRequest("DELETE", "/api/user", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, deleteAccount("wrong-password"))
+	assert.Equal(t, http.StatusOK, deleteAccount("password"))
+	assert.Equal(t, http.StatusUnauthorized, deleteAccount("password"))
+
+	_, err = suite.db.GetUserByEmail(suite.ctx, user.Email)
+	assert.Error(t, err)
+	body, err := json.Marshal(dbconnector.User{Email: user.Email, Password: "password"})
+	require.NoError(t, err)
+	req, err = http.NewRequest("POST", "/api/user/login", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Финансовые записи остались, а логин снова свободен
+	isOrderExist, _, err := suite.db.GetOrderByNumber(suite.ctx, order.Number)
+	require.NoError(t, err)
+	assert.True(t, isOrderExist)
+	withdrawals, err := suite.db.GetAddWithdrawalsByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(withdrawals))
+	err = suite.db.AddUser(suite.ctx, &dbconnector.User{Email: user.Email, Password: "password"})
+	assert.NoError(t, err)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// CSRF защита и атрибуты cookie
+// cookie сессии HttpOnly и с временем жизни, рядом выдается csrf_token
+// изменяющий запрос с cookie без X-CSRF-Token - http.StatusForbidden, с верным токеном проходит
+// GET запросы и клиенты с Bearer токеном не проверяются
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemCSRF() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+	defaultCookies := suite.ls.Cookies
+	suite.ls.Cookies.CSRF = true
+	suite.ls.Cookies.SameSite = http.SameSiteStrictMode
+	defer func() { suite.ls.Cookies = defaultCookies }()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+
+	body, err := json.Marshal(dbconnector.User{Email: user.Email, Password: "password"})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/api/user/login", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	authorization := rr.Header().Get("Authorization")
+
+	var sessionCookie, csrfCookie *http.Cookie
+	for _, cookie := range rr.Result().Cookies() {
+		switch cookie.Name {
+		case "session_token":
+			sessionCookie = cookie
+		case "csrf_token":
+			csrfCookie = cookie
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	require.NotNil(t, csrfCookie)
+	assert.True(t, sessionCookie.HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, sessionCookie.SameSite)
+	assert.Greater(t, sessionCookie.MaxAge, 0)
+	assert.False(t, csrfCookie.HttpOnly)
+
+	doRequest := func(method string, url string, body string, withCookie bool, csrfToken string, authorization string) int {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		if withCookie {
+			req.AddCookie(sessionCookie)
+		}
+		if csrfToken != "" {
+			req.Header.Set("X-CSRF-Token", csrfToken)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, doRequest("GET", "/api/user/balance", "", true, "", ""))
+	assert.Equal(t, http.StatusForbidden, doRequest("POST", "/api/user/orders", "3182649", true, "", ""))
+	assert.Equal(t, http.StatusForbidden, doRequest("POST", "/api/user/orders", "3182649", true, "forged", ""))
+	assert.Equal(t, http.StatusAccepted, doRequest("POST", "/api/user/orders", "3182649", true, csrfCookie.Value, ""))
+	assert.Equal(t, http.StatusAccepted, doRequest("POST", "/api/user/orders", "2377225624", false, "", authorization))
+	assert.Equal(t, http.StatusForbidden, doRequest("POST", "/api/user/logout", "", true, "", ""))
+	assert.Equal(t, http.StatusOK, doRequest("POST", "/api/user/logout", "", true, csrfCookie.Value, ""))
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// MakeGorutineToCheckOrdersByTimer с несколькими воркерами
+// заказы проверяются параллельно, но не больше AccrualWorkers одновременно
+// после 429 все воркеры останавливаются и больше не ходят в сервис до Retry-After
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualWorkers() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: strconv.Itoa(1000 + i), UserID: user.ID})
+		require.NoError(t, err)
+	}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight, hits := 0, 0, 0
+	tooManyRequests := false
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		if tooManyRequests {
+			mu.Unlock()
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "No more than 10 requests per minute allowed", http.StatusTooManyRequests)
+			return
+		}
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(200 * time.Millisecond)
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		json.NewEncoder(w).Encode(models.AccrualResponse{Order: number, Status: "PROCESSED", Accrual: 10})
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer accrual.Close()
+
+	ls := server.NewServerSystem(suite.db, accrual.URL, suite.ls.Tokens)
+	ls.AccrualWorkers = 4
+	ctx, cancel := context.WithCancel(suite.ctx)
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	assert.Eventually(t, func() bool {
+		orders, err := suite.waitingOrders()
+		return err == nil && len(orders) == 0
+	}, 15*time.Second, 100*time.Millisecond)
+	cancel()
+	mu.Lock()
+	assert.Greater(t, maxInFlight, 1)
+	assert.LessOrEqual(t, maxInFlight, 4)
+	mu.Unlock()
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 80.0, storedUser.Balance)
+
+	// Сервис перегружен: один цикл упирается в 429 и больше запросов не шлет
+	for i := 0; i < 20; i++ {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: strconv.Itoa(2000 + i), UserID: user.ID})
+		require.NoError(t, err)
+	}
+	mu.Lock()
+	hits, tooManyRequests = 0, true
+	mu.Unlock()
+	ctx, cancel = context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits > 0
+	}, 10*time.Second, 50*time.Millisecond)
+	time.Sleep(time.Second)
+	mu.Lock()
+	assert.LessOrEqual(t, hits, 4)
+	mu.Unlock()
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Адаптивный лимитер запросов к accrual
+// после 429 с "No more than N requests per minute allowed" запросы идут не чаще N в минуту
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualRateLimit() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: strconv.Itoa(1000 + i), UserID: user.ID})
+		require.NoError(t, err)
+	}
+
+	var mu sync.Mutex
+	var served []time.Time
+	var limitedAt time.Time
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if limitedAt.IsZero() {
+			limitedAt = time.Now()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "No more than 300 requests per minute allowed", http.StatusTooManyRequests)
+			return
+		}
+		served = append(served, time.Now())
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		json.NewEncoder(w).Encode(models.AccrualResponse{Order: number, Status: "PROCESSED", Accrual: 10})
+	}))
+	defer accrual.Close()
+
+	ls := server.NewServerSystem(suite.db, accrual.URL, suite.ls.Tokens)
+	ls.AccrualWorkers = 4
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	assert.Eventually(t, func() bool {
+		orders, err := suite.waitingOrders()
+		return err == nil && len(orders) == 0
+	}, 20*time.Second, 100*time.Millisecond)
+
+	// запросы, которые уже были в полете во время 429, не считаем.
+	// 300 в минуту с запасом - это не чаще раза в 200мс, проверяем с допуском на таймеры
+	mu.Lock()
+	defer mu.Unlock()
+	var paced []time.Time
+	for _, servedAt := range served {
+		if servedAt.Sub(limitedAt) > 500*time.Millisecond {
+			paced = append(paced, servedAt)
+		}
+	}
+	require.GreaterOrEqual(t, len(paced), 6)
+	for i := 1; i < len(paced); i++ {
+		assert.GreaterOrEqual(t, paced[i].Sub(paced[i-1]), 180*time.Millisecond)
+	}
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Повторные проверки заказов по расписанию
+// заказ, о котором accrual не знает, проверяется все реже, а заказ, которому еще рано, в сервис не уходит
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualBackoff() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	unknown := dbconnector.Order{Number: "1000", UserID: user.ID}
+	err = suite.db.AddOrder(suite.ctx, &unknown)
+	require.NoError(t, err)
+	later := dbconnector.Order{Number: "2000", UserID: user.ID}
+	err = suite.db.AddOrder(suite.ctx, &later)
+	require.NoError(t, err)
+	nextCheckAt := time.Now().Add(time.Hour)
+	later.NextCheckAt = &nextCheckAt
+	err = suite.db.ScheduleOrderCheck(suite.ctx, &later)
+	require.NoError(t, err)
+
+	// в выборку попадают только заказы, которым подошел срок
+	orders, err := suite.db.ClaimDueOrders(suite.ctx, "test", time.Now(), time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "1000", orders[0].Number)
+	err = suite.db.ReleaseOrders(suite.ctx, "test")
+	require.NoError(t, err)
+	orders, err = suite.db.ClaimDueOrders(suite.ctx, "test", time.Now().Add(2*time.Hour), time.Minute, 1)
+	require.NoError(t, err)
+	assert.Len(t, orders, 1)
+	err = suite.db.ReleaseOrders(suite.ctx, "test")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	hits := map[string]int{}
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[strings.TrimPrefix(r.URL.Path, "/api/orders/")]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer accrual.Close()
+
+	ls := server.NewServerSystem(suite.db, accrual.URL, suite.ls.Tokens)
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	var stored dbconnector.Order
+	assert.Eventually(t, func() bool {
+		_, stored, err = suite.db.GetOrderByNumber(suite.ctx, "1000")
+		return err == nil && stored.Attempts >= 2
+	}, 20*time.Second, 100*time.Millisecond)
+	cancel()
+
+	require.NotNil(t, stored.NextCheckAt)
+	assert.True(t, stored.NextCheckAt.After(time.Now().Add(-time.Second)))
+	assert.Equal(t, "NEW", stored.Status)
+	mu.Lock()
+	assert.GreaterOrEqual(t, hits["1000"], 2)
+	assert.Zero(t, hits["2000"])
+	mu.Unlock()
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Несколько реплик сервиса проверяют заказы из одной базы
+// каждая берет заказы в аренду, так что каждый заказ проверяется и начисляется один раз
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualLeasing() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	// у каждого заказа свой пользователь: двойное начисление видно по балансу
+	users := make([]dbconnector.User, 40)
+	for i := range users {
+		users[i] = dbconnector.User{Email: fmt.Sprintf("test%d@example.com", i), Password: "password"}
+		err := suite.db.AddUser(suite.ctx, &users[i])
+		require.NoError(t, err)
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: strconv.Itoa(1000 + i), UserID: users[i].ID})
+		require.NoError(t, err)
+	}
+
+	// одновременные аренды не пересекаются
+	var mu sync.Mutex
+	claimed := map[string]string{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			orders, err := suite.db.ClaimDueOrders(suite.ctx, owner, time.Now(), time.Minute, 15)
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ord := range orders {
+				assert.Empty(t, claimed[ord.Number], "order %s claimed twice", ord.Number)
+				claimed[ord.Number] = owner
+			}
+		}("instance-" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	assert.Len(t, claimed, 40)
+	orders, err := suite.db.ClaimDueOrders(suite.ctx, "instance-x", time.Now(), time.Minute, 100)
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+	// истекшую аренду может забрать другая реплика
+	orders, err = suite.db.ClaimDueOrders(suite.ctx, "instance-x", time.Now().Add(2*time.Minute), time.Minute, 100)
+	require.NoError(t, err)
+	assert.Len(t, orders, 40)
+	err = suite.db.ReleaseOrders(suite.ctx, "instance-x")
+	require.NoError(t, err)
+
+	hits := map[string]int{}
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		mu.Lock()
+		hits[number]++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(models.AccrualResponse{Order: number, Status: "PROCESSED", Accrual: 10})
+	}))
+	defer accrual.Close()
+
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		ls := server.NewServerSystem(suite.db, accrual.URL, suite.ls.Tokens)
+		ls.AccrualWorkers = 4
+		ls.AccrualBatchSize = 10
+		server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+	}
+
+	assert.Eventually(t, func() bool {
+		orders, err := suite.waitingOrders()
+		return err == nil && len(orders) == 0
+	}, 30*time.Second, 100*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	assert.Len(t, hits, 40)
+	for number, count := range hits {
+		assert.Equal(t, 1, count, "order %s polled more than once", number)
+	}
+	mu.Unlock()
+	for _, user := range users {
+		storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, storedUser.Balance)
+	}
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Начисление баллов за заказ
+// параллельные попытки применить один и тот же результат начисляют баллы один раз,
+// а параллельные начисления и списания не теряют друг друга
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualCrediting() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password", Balance: 1000}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: strconv.Itoa(1000 + i), UserID: user.ID})
+		require.NoError(t, err)
+	}
+	orders, err := suite.db.ClaimDueOrders(suite.ctx, "instance", time.Now(), time.Minute, 100)
+	require.NoError(t, err)
+	require.Len(t, orders, 20)
+
+	// один заказ, десять одновременных попыток
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ord := orders[0]
+			ord.Status, ord.Points = "PROCESSED", 10
+			applied, err := suite.db.ApplyAccrualResult(suite.ctx, &ord, "instance")
+			assert.NoError(t, err)
+			assert.True(t, applied)
+		}()
+	}
+	wg.Wait()
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1010.0, storedUser.Balance)
+	_, storedOrder, err := suite.db.GetOrderByNumber(suite.ctx, orders[0].Number)
+	require.NoError(t, err)
+	assert.True(t, storedOrder.Credited)
+
+	// чужая аренда - результат не применяется
+	ord := orders[1]
+	ord.Status, ord.Points = "PROCESSED", 10
+	applied, err := suite.db.ApplyAccrualResult(suite.ctx, &ord, "other-instance")
+	require.NoError(t, err)
+	assert.False(t, applied)
+
+	// остальные заказы начисляются одновременно со списаниями того же пользователя
+	for i, ord := range orders[1:] {
+		wg.Add(2)
+		go func(ord dbconnector.Order) {
+			defer wg.Done()
+			ord.Status, ord.Points = "PROCESSED", 10
+			_, err := suite.db.ApplyAccrualResult(suite.ctx, &ord, "instance")
+			assert.NoError(t, err)
+		}(ord)
+		go func(number string) {
+			defer wg.Done()
+			var checkedUser dbconnector.User
+			err := suite.db.WithdrawalTransaction(suite.ctx,
+				&dbconnector.Order{Number: number, UserID: user.ID, Status: "PROCESSED"},
+				&dbconnector.Withdrawal{Points: 20, UserID: user.ID, Number: number},
+				&checkedUser, user.Email, 20)
+			assert.NoError(t, err)
+		}(strconv.Itoa(5000 + i))
+	}
+	wg.Wait()
+	storedUser, err = suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1010.0+19*10-19*20, storedUser.Balance)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Статусы заказа
+// статусы accrual переводятся в статусы из спецификации, окончательный статус не меняется
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemOrderStatusMachine() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	testCases := []struct {
+		current       string
+		accrualStatus string
+		expected      service.OrderStatus
+		expectedErr   error
+	}{
+		{current: "NEW", accrualStatus: "REGISTERED", expected: service.OrderStatusProcessing},
+		{current: "NEW", accrualStatus: "PROCESSED", expected: service.OrderStatusProcessed},
+		{current: "PROCESSING", accrualStatus: "PROCESSING", expected: service.OrderStatusProcessing},
+		{current: "PROCESSING", accrualStatus: "INVALID", expected: service.OrderStatusInvalid},
+		{current: "REGISTERED", accrualStatus: "PROCESSED", expected: service.OrderStatusProcessed},
+		{current: "PROCESSED", accrualStatus: "PROCESSING", expectedErr: errors.ErrIllegalOrderStatusTransition},
+		{current: "INVALID", accrualStatus: "PROCESSED", expectedErr: errors.ErrIllegalOrderStatusTransition},
+		{current: "NEW", accrualStatus: "LOST", expectedErr: errors.ErrUnknownOrderStatus},
+	}
+	for _, tc := range testCases {
+		next, err := service.NextOrderStatus("3182649", tc.current, tc.accrualStatus)
+		if tc.expectedErr != nil {
+			assert.ErrorIs(t, err, tc.expectedErr, "%s -> %s", tc.current, tc.accrualStatus)
+			continue
+		}
+		require.NoError(t, err, "%s -> %s", tc.current, tc.accrualStatus)
+		assert.Equal(t, tc.expected, next, "%s -> %s", tc.current, tc.accrualStatus)
+	}
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: "3182649", UserID: user.ID})
+	require.NoError(t, err)
+
+	// сначала accrual только регистрирует заказ, потом рассчитывает
+	var mu sync.Mutex
+	accrualStatus := "REGISTERED"
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		response := models.AccrualResponse{Order: number, Status: accrualStatus}
+		if accrualStatus == "PROCESSED" {
+			response.Accrual = 15
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer accrual.Close()
+
+	ls := server.NewServerSystem(suite.db, accrual.URL, suite.ls.Tokens)
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	assert.Eventually(t, func() bool {
+		_, order, err := suite.db.GetOrderByNumber(suite.ctx, "3182649")
+		return err == nil && order.Status != "NEW"
+	}, 10*time.Second, 100*time.Millisecond)
+	req, err := http.NewRequest("GET", "/api/user/orders", nil)
+	require.NoError(t, err)
+	req.AddCookie(suite.sessionCookie(t, user.Email))
+	rr := httptest.NewRecorder()
+	suite.router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var orderResponses []models.OrderResponse
+	err = json.NewDecoder(rr.Body).Decode(&orderResponses)
+	require.NoError(t, err)
+	require.Len(t, orderResponses, 1)
+	assert.Equal(t, "PROCESSING", orderResponses[0].Status)
+
+	mu.Lock()
+	accrualStatus = "PROCESSED"
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		_, order, err := suite.db.GetOrderByNumber(suite.ctx, "3182649")
+		return err == nil && order.Status == "PROCESSED"
+	}, 15*time.Second, 100*time.Millisecond)
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, storedUser.Balance)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// HTTP клиент accrual
+// повторяет запрос после 5xx, разбирает 204 и 429 в результат и не ждет ответа дольше таймаута
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualClient() {
+	t := suite.T()
+
+	var mu sync.Mutex
+	hits := map[string]int{}
+	accrualServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		mu.Lock()
+		hits[number]++
+		count := hits[number]
+		mu.Unlock()
+		switch number {
+		case "3182649":
+			// сервис дважды падает, потом отвечает
+			if count < 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(models.AccrualResponse{Order: number, Status: "PROCESSED", Accrual: 5.5})
+		case "2377225624":
+			w.WriteHeader(http.StatusNoContent)
+		case "12345678903":
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "No more than 12 requests per minute allowed", http.StatusTooManyRequests)
+		default:
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer accrualServer.Close()
+
+	client := accrual.NewClient(accrual.Config{BaseURL: accrualServer.URL, Timeout: 200 * time.Millisecond, Retries: 2, RetryDelay: 10 * time.Millisecond})
+
+	result, err := client.GetOrder(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.Equal(t, service.AccrualResult{Status: "PROCESSED", Accrual: 5.5}, result)
+
+	result, err = client.GetOrder(suite.ctx, "2377225624")
+	require.NoError(t, err)
+	assert.True(t, result.NotRegistered)
+
+	result, err = client.GetOrder(suite.ctx, "12345678903")
+	require.NoError(t, err)
+	assert.True(t, result.TooManyRequests)
+	assert.Equal(t, 7*time.Second, result.RetryAfter)
+	assert.Equal(t, 12, result.RequestsPerMinute)
+
+	start := time.Now()
+	_, err = client.GetOrder(suite.ctx, "79927398713")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, hits["3182649"])
+	// 429 не повторяем, это решает тот, кто опрашивает заказы
+	assert.Equal(t, 1, hits["12345678903"])
+	assert.Equal(t, 3, hits["79927398713"])
+}
+
+// Опрос заказов через подмененный клиент accrual
+// логика начисления не зависит от HTTP: тест отвечает за accrual сам
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualClientStub() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for _, number := range []string{"3182649", "2377225624", "12345678903"} {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: number, UserID: user.ID})
+		require.NoError(t, err)
+	}
+
+	ls := server.NewServerSystem(suite.db, "", suite.ls.Tokens)
+	ls.Accrual = &stubAccrualClient{results: map[string]service.AccrualResult{
+		"3182649":     {Status: "PROCESSED", Accrual: 30},
+		"2377225624":  {Status: "INVALID"},
+		"12345678903": {Status: "REGISTERED"},
+	}}
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	assert.Eventually(t, func() bool {
+		orders, err := suite.waitingOrders()
+		return err == nil && len(orders) == 1 && orders[0].Status == "PROCESSING"
+	}, 10*time.Second, 100*time.Millisecond)
+	cancel()
+
+	_, order, err := suite.db.GetOrderByNumber(suite.ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", order.Status)
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 30.0, storedUser.Balance)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Опрос заказов в имитации accrual
+// заказы проходят REGISTERED -> PROCESSING -> окончательный статус по правилам имитации,
+// незарегистрированный заказ остается NEW, а сверх лимита имитация отвечает 429
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualMock() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for _, number := range []string{"3182649", "2377225624", "79927398713"} {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: number, UserID: user.ID})
+		require.NoError(t, err)
+	}
+
+	rules, err := accrualmock.ParseRules("2=INVALID")
+	require.NoError(t, err)
+	mock := accrualmock.New(accrualmock.Config{
+		RegisteredFor: 500 * time.Millisecond,
+		ProcessingFor: 500 * time.Millisecond,
+		Rules:         rules,
+	})
+	mock.Register("3182649")
+	mock.Register("2377225624")
+	accrualServer := httptest.NewServer(mock)
+	defer accrualServer.Close()
+
+	ls := server.NewServerSystem(suite.db, accrualServer.URL, suite.ls.Tokens)
+	ctx, cancel := context.WithCancel(suite.ctx)
+	defer cancel()
+	server.MakeGorutineToCheckOrdersByTimer(ctx, ls)
+
+	assert.Eventually(t, func() bool {
+		orders, err := suite.waitingOrders()
+		return err == nil && len(orders) == 1
+	}, 20*time.Second, 100*time.Millisecond)
+	cancel()
+
+	_, order, err := suite.db.GetOrderByNumber(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Equal(t, accrualmock.DefaultAccrual("3182649"), order.Points)
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", order.Status)
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Greater(t, order.Attempts, 0)
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, accrualmock.DefaultAccrual("3182649"), storedUser.Balance)
+
+	// лимит запросов
+	limited := httptest.NewServer(accrualmock.New(accrualmock.Config{AutoRegister: true, RateLimit: 2}))
+	defer limited.Close()
+	client := accrual.NewClient(accrual.Config{BaseURL: limited.URL})
+	for i := 0; i < 2; i++ {
+		result, err := client.GetOrder(suite.ctx, "3182649")
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", result.Status)
+	}
+	result, err := client.GetOrder(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.True(t, result.TooManyRequests)
+	assert.Equal(t, 2, result.RequestsPerMinute)
+	assert.Greater(t, result.RetryAfter, time.Duration(0))
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Результаты расчета, которые accrual присылает сам
+// принимаются только с верной подписью, проходят через машину состояний и начисляют баллы один раз
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemAccrualWebhook() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	user := dbconnector.User{Email: "test@example.com", Password: "password"}
+	err := suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	for _, number := range []string{"3182649", "2377225624", "79927398713"} {
+		err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: number, UserID: user.ID})
+		require.NoError(t, err)
+	}
+	// этот заказ сейчас проверяет опрос
+	_, claimed, err := suite.db.ClaimOrder(suite.ctx, "79927398713", "poller", time.Now(), time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	ls := server.NewServerSystem(suite.db, "", suite.ls.Tokens)
+	ls.AccrualWebhookSecret = "webhook-secret"
+	handlers := ls.MakeRouter()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sign := func(timestamp string, body []byte) string {
+		mac := hmac.New(sha256.New, []byte("webhook-secret"))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		return "sha256=" + fmt.Sprintf("%x", mac.Sum(nil))
+	}
+	pushAt := func(timestamp string, body string, signature string) (int, []models.AccrualWebhookResult) {
+		req, err := http.NewRequest("POST", "/api/accrual/webhook", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Timestamp", timestamp)
+		if signature != "" {
+			req.Header.Set("X-Signature", signature)
+		}
+		rr := httptest.NewRecorder()
+		handlers.ServeHTTP(rr, req)
+		var outcomes []models.AccrualWebhookResult
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&outcomes))
+		}
+		return rr.Code, outcomes
+	}
+	push := func(body string, signature string) (int, []models.AccrualWebhookResult) {
+		return pushAt(now, body, signature)
+	}
+
+	single := `{"order": "3182649", "status": "PROCESSED", "accrual": 50}`
+	code, _ := push(single, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = push(single, sign(now, []byte(`{"order": "3182649", "status": "PROCESSED", "accrual": 5000}`)))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	// время входит в подпись: подменить его нельзя, а старую подпись повторить нельзя
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	code, _ = pushAt(now, single, sign(stale, []byte(single)))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = pushAt(stale, single, sign(stale, []byte(single)))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	_, order, err := suite.db.GetOrderByNumber(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+
+	code, outcomes := push(single, sign(now, []byte(single)))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []models.AccrualWebhookResult{{Order: "3182649", Result: service.WebhookResultApplied}}, outcomes)
+
+	// заказ уже в окончательном статусе: ни повтор, ни другое начисление его не меняют
+	other := `{"order": "3182649", "status": "PROCESSED", "accrual": 70}`
+	for _, body := range []string{single, other} {
+		code, outcomes = push(body, sign(now, []byte(body)))
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []models.AccrualWebhookResult{{Order: "3182649", Result: service.WebhookResultRejected}}, outcomes)
+	}
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 50.0, storedUser.Balance)
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.Equal(t, 50.0, order.Points)
+
+	// за номер заказа на списание баллы не начисляются
+	logicSystem := service.LogicSystem{Ctx: suite.ctx, Storage: suite.db, User: &storedUser}
+	_, err = logicSystem.WithdrawLogic(models.WithdrawRequest{Order: "4561261212345467", Sum: 20}, 0)
+	require.NoError(t, err)
+	withdrawalPush := `{"order": "4561261212345467", "status": "PROCESSED", "accrual": 1000}`
+	code, outcomes = push(withdrawalPush, sign(now, []byte(withdrawalPush)))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []models.AccrualWebhookResult{{Order: "4561261212345467", Result: service.WebhookResultRejected}}, outcomes)
+	storedUser, err = suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 30.0, storedUser.Balance)
+
+	batch := `[
+		{"order": "2377225624", "status": "REGISTERED"},
+		{"order": "79927398713", "status": "PROCESSED", "accrual": 10},
+		{"order": "12345678903", "status": "PROCESSED", "accrual": 10},
+		{"order": "3182649", "status": "PROCESSING"}
+	]`
+	code, outcomes = push(batch, sign(now, []byte(batch)))
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []models.AccrualWebhookResult{
+		{Order: "2377225624", Result: service.WebhookResultApplied},
+		{Order: "79927398713", Result: service.WebhookResultBusy},
+		{Order: "12345678903", Result: service.WebhookResultNotFound},
+		{Order: "3182649", Result: service.WebhookResultRejected},
+	}, outcomes)
+
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSING", order.Status)
+	// заказ без окончательного статуса по-прежнему проверяется опросом
+	require.NotNil(t, order.NextCheckAt)
+	assert.Empty(t, order.LeaseOwner)
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "3182649")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	_, order, err = suite.db.GetOrderByNumber(suite.ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Equal(t, "poller", order.LeaseOwner)
+	storedUser, err = suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 30.0, storedUser.Balance)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// Начисление во время смены пароля
+// пока запрос смены пароля держит старую копию пользователя, приходит начисление - оно не должно потеряться
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemCreditDuringPasswordChange() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword), Balance: 100}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	err = suite.db.AddOrder(suite.ctx, &dbconnector.Order{Number: "3182649", UserID: user.ID})
+	require.NoError(t, err)
+
+	// так пользователя загружает auth middleware в начале запроса
+	staleUser, err := suite.db.GetUserByEmail(suite.ctx, user.Email)
+	require.NoError(t, err)
+
+	orders, err := suite.db.ClaimDueOrders(suite.ctx, "instance", time.Now(), time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	orders[0].Status, orders[0].Points = "PROCESSED", 40
+	applied, err := suite.db.ApplyAccrualResult(suite.ctx, &orders[0], "instance")
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	logicSystem := service.LogicSystem{Ctx: suite.ctx, Storage: suite.db, User: &staleUser}
+	policy := service.DefaultPasswordPolicy()
+	policy.Cost = bcrypt.MinCost
+	code, err := logicSystem.ChangePasswordLogic(models.ChangePasswordRequest{CurrentPassword: "old-password", NewPassword: "new-password"}, 0, policy)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	storedUser, err := suite.db.GetUserByUserID(suite.ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 140.0, storedUser.Balance)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte("new-password")))
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+// RequestAccountDeletionHandler, DeleteAccountHandler
+// пользователь, созданный через SSO, не знает свой случайный пароль и подтверждает удаление токеном из письма.
+// Чужой или уже использованный токен - http.StatusUnauthorized
+func (suite *LoyaltySystemTestSuite) TestLoyaltySystemDeleteSSOAccount() {
+	if testing.Short() {
+		suite.T().Skip("Skipping integration test")
+	}
+	t := suite.T()
+
+	mail := &testMailer{}
+	defaultMailer := suite.ls.Mailer
+	suite.ls.Mailer = mail
+	defer func() { suite.ls.Mailer = defaultMailer }()
+
+	// Перестраховка на всякий случай
+	suite.db.DeleteAllData(suite.ctx)
+	subject := "sso-subject"
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("random-password-nobody-knows"), bcrypt.MinCost)
+	require.NoError(t, err)
+	user := dbconnector.User{Email: "test@example.com", Password: string(hashedPassword), OIDCSubject: &subject}
+	err = suite.db.AddUser(suite.ctx, &user)
+	require.NoError(t, err)
+	other := dbconnector.User{Email: "other@example.com", Password: string(hashedPassword)}
+	err = suite.db.AddUser(suite.ctx, &other)
+	require.NoError(t, err)
+	cookie := suite.sessionCookie(t, user.Email)
+	otherCookie := suite.sessionCookie(t, other.Email)
+
+	do := func(method string, url string, payload interface{}, cookie *http.Cookie) int {
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		suite.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	requestToken := func(cookie *http.Cookie) string {
+		require.Equal(t, http.StatusAccepted, do("POST", "/api/user/delete/request", nil, cookie))
+		match := deletionTokenRegexp.FindStringSubmatch(mail.bodies[len(mail.bodies)-1])
+		require.Len(t, match, 2)
+		return match[1]
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("DELETE", "/api/user", models.DeleteAccountRequest{}, cookie))
+	assert.Equal(t, http.StatusUnauthorized, do("DELETE", "/api/user", models.DeleteAccountRequest{Token: "wrong"}, cookie))
+	// токен другого пользователя не подходит
+	otherToken := requestToken(otherCookie)
+	assert.Equal(t, http.StatusUnauthorized, do("DELETE", "/api/user", models.DeleteAccountRequest{Token: otherToken}, cookie))
+	_, err = suite.db.GetUserByEmail(suite.ctx, user.Email)
+	require.NoError(t, err)
+
+	token := requestToken(cookie)
+	assert.Equal(t, http.StatusOK, do("DELETE", "/api/user", models.DeleteAccountRequest{Token: token}, cookie))
+	_, err = suite.db.GetUserByEmail(suite.ctx, user.Email)
+	assert.Error(t, err)
+	_, err = suite.db.GetUserByOIDCSubject(suite.ctx, subject)
+	assert.Error(t, err)
+	_, err = suite.db.GetUserByEmail(suite.ctx, other.Email)
+	assert.NoError(t, err)
+
+	// Clean up test data
+	suite.db.DeleteAllData(suite.ctx)
+}
+
+var resetTokenRegexp = regexp.MustCompile(`Reset token: ([0-9a-f]+)`)
+var verificationTokenRegexp = regexp.MustCompile(`Verification token: ([0-9a-f]+)`)
+var deletionTokenRegexp = regexp.MustCompile(`Deletion token: ([0-9a-f]+)`)
+
+// testMailer запоминает письма вместо отправки
+type testMailer struct {
+	bodies []string
+}
+
+func (m *testMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+// mockOIDCProvider минимальный OpenID Connect провайдер: discovery, JWKS и token endpoint,
+// выдает id_token на тот subject и почту, что выставил тест
+type mockOIDCProvider struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	signingKey    *rsa.PrivateKey
+	subject       string
+	email         string
+	emailVerified bool
+	nonce         string
+	// kid в заголовке выдаваемых id_token
+	kid      string
+	jwksHits atomic.Int32
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &mockOIDCProvider{key: key, signingKey: key, kid: "test-key"}
+
+	handlers := http.NewServeMux()
+	handlers.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/authorize",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/jwks",
+		})
+	})
+	handlers.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		provider.jwksHits.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"n":   base64.RawURLEncoding.EncodeToString(provider.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.E)).Bytes()),
+			}},
+		})
+	})
+	handlers.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "gophermart" || clientSecret != "client-secret" || r.FormValue("code") != "auth-code" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.idToken(t)})
+	})
+	provider.server = httptest.NewServer(handlers)
+	return provider
+}
+
+func (p *mockOIDCProvider) idToken(t *testing.T) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": p.kid})
+	require.NoError(t, err)
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":            p.server.URL,
+		"sub":            p.subject,
+		"aud":            "gophermart",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          p.nonce,
+		"email":          p.email,
+		"email_verified": p.emailVerified,
+	})
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.signingKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// stubAccrualClient отвечает на запросы о заказах заранее заданными результатами, неизвестный заказ - 204
+type stubAccrualClient struct {
+	results map[string]service.AccrualResult
+}
+
+func (c *stubAccrualClient) GetOrder(ctx context.Context, number string) (service.AccrualResult, error) {
+	result, ok := c.results[number]
+	if !ok {
+		return service.AccrualResult{NotRegistered: true}, nil
+	}
+	return result, nil
+}
+
+// waitingOrders заказы, которые еще ждут окончательного статуса от accrual.
+// Читаем напрямую из базы: в Storage заказы доступны только через аренду
+func (suite *LoyaltySystemTestSuite) waitingOrders() ([]dbconnector.Order, error) {
+	var orders []dbconnector.Order
+	result := suite.db.DB.Where("status IN ('REGISTERED', 'PROCESSING', 'NEW')").Find(&orders)
+	return orders, result.Error
+}
+
+// sessionCookie заводит новую сессию для пользователя с таким email и выпускает под нее токен
+func (suite *LoyaltySystemTestSuite) sessionCookie(t *testing.T, email string) *http.Cookie {
+	user, err := suite.db.GetUserByEmail(suite.ctx, email)
+	require.NoError(t, err)
+	logicSystem := service.LogicSystem{Ctx: suite.ctx, Storage: suite.db, User: &user}
+	session, err := logicSystem.CreateSessionLogic("test", "127.0.0.1", time.Hour)
+	require.NoError(t, err)
+	token, err := suite.ls.Tokens.Issue(user.ID, session.ID)
+	require.NoError(t, err)
+	return &http.Cookie{Name: "session_token", Value: token}
+}
+
 func (suite *LoyaltySystemTestSuite) TestLunh() {
 	number := "3182649"
 	res := service.IsValidLuhn(number)
@@ -2,20 +2,33 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/theheadmen/goDipl2/internal/accrual"
 	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/mailer"
+	"github.com/theheadmen/goDipl2/internal/oidc"
 	"github.com/theheadmen/goDipl2/internal/server"
 	"github.com/theheadmen/goDipl2/internal/serverconfig"
+	"github.com/theheadmen/goDipl2/internal/service"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
 	configStore := serverconfig.NewConfigStore()
 	configStore.ParseFlags()
+	if configStore.FlagSecretKey == "" && !configStore.FlagDevMode {
+		// со случайным ключом сессии молча ломаются после перезапуска и не работают между репликами
+		log.Fatal("Secret key is not set: pass -k or SECRET_KEY, or -dev / DEV_MODE=true for a random development key")
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -27,7 +40,63 @@ func main() {
 	if err := db.DBInitialize(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	ls := server.NewServerSystem(db, configStore.FlagAccrual)
+	passwords, err := newPasswordPolicy(configStore)
+	if err != nil {
+		log.Fatalf("Failed to set up password policy: %v", err)
+	}
+	if configStore.FlagAdminLogin != "" {
+		logicSystem := service.LogicSystem{Ctx: ctx, Storage: db}
+		if err := logicSystem.SeedAdminLogic(configStore.FlagAdminLogin, configStore.FlagAdminPassword, passwords); err != nil {
+			log.Fatalf("Failed to seed admin %s: %v", configStore.FlagAdminLogin, err)
+		}
+	}
+	if configStore.FlagSecretKey == "" {
+		// только в режиме разработки: генерируем случайный ключ, токены не переживут перезапуск
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Failed to generate secret key: %v", err)
+		}
+		configStore.FlagSecretKey = hex.EncodeToString(key)
+		log.Println("Secret key is not set, using random one: sessions will not survive restart")
+	}
+	tokens := service.NewTokenManager(configStore.FlagSecretKey, configStore.FlagTokenTTL)
+
+	ls := server.NewServerSystem(db, configStore.FlagAccrual, tokens)
+	ls.ResetTokenTTL = configStore.FlagResetTTL
+	ls.Lockout = service.LockoutPolicy{
+		MaxLoginFailures: configStore.FlagLoginMaxFailures,
+		MaxIPFailures:    configStore.FlagIPMaxFailures,
+		LockoutDuration:  configStore.FlagLockoutDuration,
+		MaxLockout:       configStore.FlagMaxLockout,
+	}
+	ls.Passwords = passwords
+	ls.Cookies, err = newCookiePolicy(configStore)
+	if err != nil {
+		log.Fatalf("Failed to set up cookies: %v", err)
+	}
+	ls.EmailVerification = configStore.FlagEmailVerification
+	ls.VerificationTokenTTL = configStore.FlagVerificationTTL
+	ls.AccrualWorkers = configStore.FlagAccrualWorkers
+	ls.AccrualRateLimit = configStore.FlagAccrualRateLimit
+	ls.AccrualBatchSize = configStore.FlagAccrualBatchSize
+	ls.AccrualMaxBackoff = configStore.FlagAccrualMaxBackoff
+	ls.AccrualLeaseTTL = configStore.FlagAccrualLeaseTTL
+	ls.AccrualWebhookSecret = configStore.FlagAccrualWebhookSecret
+	ls.Accrual, err = newAccrualClient(configStore)
+	if err != nil {
+		log.Fatalf("Failed to set up accrual client: %v", err)
+	}
+	ls.WithdrawTOTPThreshold = configStore.FlagWithdrawTOTPThreshold
+	ls.Mailer, err = newMailer(configStore)
+	if err != nil {
+		log.Fatalf("Failed to set up mailer: %v", err)
+	}
+	if configStore.FlagOIDCIssuer != "" {
+		ls.OIDC, err = oidc.NewProvider(ctx, configStore.FlagOIDCIssuer, configStore.FlagOIDCClientID, configStore.FlagOIDCClientSecret, configStore.FlagOIDCRedirectURL)
+		if err != nil {
+			log.Fatalf("Failed to set up OIDC provider: %v", err)
+		}
+	}
 	srv := ls.MakeServer(configStore.FlagRunAddr)
 
 	// Горутина, которая выполняет проверяет orders раз в 30 секунд
@@ -43,3 +112,71 @@ func main() {
 	// Ожидание сигнала завершения
 	<-ctx.Done()
 }
+
+// newMailer выбирает способ отправки писем: SMTP, файл или stdout для локальной разработки
+func newMailer(configStore *serverconfig.ConfigStore) (mailer.Mailer, error) {
+	if configStore.FlagSMTPAddr != "" {
+		return mailer.NewSMTPMailer(configStore.FlagSMTPAddr, configStore.FlagMailFrom, configStore.FlagSMTPUser, configStore.FlagSMTPPass), nil
+	}
+	if configStore.FlagMailFile != "" {
+		return mailer.NewFileMailer(configStore.FlagMailFile)
+	}
+	return mailer.NewWriterMailer(os.Stdout), nil
+}
+
+// newAccrualClient HTTP клиент системы расчета начислений с таймаутами, повторами и TLS из конфига
+func newAccrualClient(configStore *serverconfig.ConfigStore) (*accrual.Client, error) {
+	tlsConfig, err := accrual.LoadTLSConfig(configStore.FlagAccrualCAFile, configStore.FlagAccrualClientCert,
+		configStore.FlagAccrualClientKey, configStore.FlagAccrualInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return accrual.NewClient(accrual.Config{
+		BaseURL: configStore.FlagAccrual,
+		Timeout: configStore.FlagAccrualTimeout,
+		Retries: configStore.FlagAccrualRetries,
+		TLS:     tlsConfig,
+	}), nil
+}
+
+// newPasswordPolicy собирает политику паролей из конфига, вместе со списком запрещенных паролей
+func newPasswordPolicy(configStore *serverconfig.ConfigStore) (service.PasswordPolicy, error) {
+	policy := service.PasswordPolicy{
+		Cost:      configStore.FlagBcryptCost,
+		MinLength: configStore.FlagPasswordMinLength,
+		DenyList:  map[string]bool{},
+	}
+	if configStore.FlagBcryptCost < bcrypt.MinCost || configStore.FlagBcryptCost > bcrypt.MaxCost {
+		return policy, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if configStore.FlagPasswordDenyList != "" {
+		denyList, err := service.LoadPasswordDenyList(configStore.FlagPasswordDenyList)
+		if err != nil {
+			return policy, err
+		}
+		policy.DenyList = denyList
+	}
+	return policy, nil
+}
+
+// newCookiePolicy разбирает настройки cookie, SameSite=None браузеры принимают только вместе с Secure
+func newCookiePolicy(configStore *serverconfig.ConfigStore) (server.CookiePolicy, error) {
+	policy := server.CookiePolicy{
+		Secure: configStore.FlagCookieSecure,
+		CSRF:   configStore.FlagCSRF,
+	}
+	switch strings.ToLower(configStore.FlagCookieSameSite) {
+	case "lax":
+		policy.SameSite = http.SameSiteLaxMode
+	case "strict":
+		policy.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !policy.Secure {
+			return policy, fmt.Errorf("cookie SameSite=None requires secure cookies")
+		}
+		policy.SameSite = http.SameSiteNoneMode
+	default:
+		return policy, fmt.Errorf("unknown cookie SameSite %q", configStore.FlagCookieSameSite)
+	}
+	return policy, nil
+}
@@ -0,0 +1,164 @@
+package accrual
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+// limitRegexp тело ответа 429 от accrual: "No more than N requests per minute allowed"
+var limitRegexp = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+// Config настройки HTTP клиента accrual, нулевые Timeout и RetryDelay заменяются значениями по умолчанию
+type Config struct {
+	BaseURL string
+	// Timeout на одну попытку запроса целиком, вместе с чтением тела
+	Timeout time.Duration
+	// Retries сколько раз повторяем запрос после сетевой ошибки или 5xx, RetryDelay пауза перед первым повтором,
+	// дальше она удваивается
+	Retries    int
+	RetryDelay time.Duration
+	// TLS настройки для https адреса accrual, nil - системные
+	TLS *tls.Config
+}
+
+// Client реализация service.AccrualClient поверх HTTP API системы расчета начислений
+type Client struct {
+	baseURL    string
+	retries    int
+	retryDelay time.Duration
+	client     *http.Client
+}
+
+var _ service.AccrualClient = (*Client)(nil)
+
+func NewClient(cfg Config) *Client {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 200 * time.Millisecond
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLS != nil {
+		transport.TLSClientConfig = cfg.TLS
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(cfg.BaseURL, "/"),
+		retries:    cfg.Retries,
+		retryDelay: cfg.RetryDelay,
+		client:     &http.Client{Timeout: cfg.Timeout, Transport: transport},
+	}
+}
+
+// LoadTLSConfig собирает TLS настройки: свой CA для проверки сертификата accrual,
+// клиентский сертификат для mTLS и, только для отладки, отключение проверки сертификата
+func LoadTLSConfig(caFile string, certFile string, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read accrual CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load accrual client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// GetOrder GET /api/orders/{number}. Сетевые ошибки и 5xx повторяем, 429 не повторяем:
+// ждать или нет решает вызывающий
+func (c *Client) GetOrder(ctx context.Context, number string) (service.AccrualResult, error) {
+	delay := c.retryDelay
+	var result service.AccrualResult
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		result, retry, err = c.getOrder(ctx, number)
+		if err == nil || !retry || attempt >= c.retries {
+			return result, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// getOrder одна попытка запроса, retry - ошибку имеет смысл повторить
+func (c *Client) getOrder(ctx context.Context, number string) (service.AccrualResult, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(number), nil)
+	if err != nil {
+		return service.AccrualResult{}, false, fmt.Errorf("ошибка при составлении запроса: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return service.AccrualResult{}, ctx.Err() == nil, fmt.Errorf("ошибка при отправке запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return service.AccrualResult{NotRegistered: true}, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		result := service.AccrualResult{TooManyRequests: true}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			result.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		// из тела узнаем лимит сервиса, чтобы дальше не упираться в него
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if match := limitRegexp.FindSubmatch(body); match != nil {
+			result.RequestsPerMinute, _ = strconv.Atoi(string(match[1]))
+		}
+		return result, false, nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return service.AccrualResult{}, true, fmt.Errorf("внутренняя ошибка сервера: %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return service.AccrualResult{}, false, fmt.Errorf("неожиданный код ответа %d", resp.StatusCode)
+	}
+
+	// Читаем тело ответа
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return service.AccrualResult{}, ctx.Err() == nil, fmt.Errorf("ошибка при чтении тела ответа: %w", err)
+	}
+	var orderResponse models.AccrualResponse
+	err = json.Unmarshal(body, &orderResponse)
+	if err != nil {
+		return service.AccrualResult{}, false, fmt.Errorf("ошибка при декодировании JSON: %w. Неправильный JSON: %s", err, body)
+	}
+	return service.AccrualResult{Status: orderResponse.Status, Accrual: orderResponse.Accrual}, false, nil
+}
@@ -0,0 +1,209 @@
+package accrualmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+// Rule результат расчета для заказов, номер которых начинается с Prefix.
+// Для PROCESSED отрицательный Accrual означает начисление по умолчанию (DefaultAccrual)
+type Rule struct {
+	Prefix  string
+	Status  string
+	Accrual float64
+}
+
+// Config поведение имитации системы расчета начислений
+type Config struct {
+	// AutoRegister заказ с корректным по Луну номером регистрируется при первом запросе о нем,
+	// иначе известны только заказы, зарегистрированные через Register или POST /api/orders
+	AutoRegister bool
+	// RegisteredFor сколько заказ после регистрации в статусе REGISTERED, ProcessingFor - потом в PROCESSING
+	RegisteredFor time.Duration
+	ProcessingFor time.Duration
+	// Rules окончательный результат расчета, первое подходящее по префиксу правило.
+	// Если ни одно не подошло - PROCESSED с DefaultAccrual(number)
+	Rules []Rule
+	// RateLimit сколько запросов в минуту принимаем, дальше 429 с Retry-After до конца минуты, 0 - без ограничения
+	RateLimit int
+	// Now часы, по умолчанию time.Now
+	Now func() time.Time
+}
+
+// Server имитация accrual: GET /api/orders/{number} и POST /api/orders для регистрации заказа
+type Server struct {
+	cfg Config
+
+	mu          sync.Mutex
+	registered  map[string]time.Time
+	windowStart time.Time
+	requests    int
+	router      *mux.Router
+}
+
+func New(cfg Config) *Server {
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	s := &Server{cfg: cfg, registered: map[string]time.Time{}}
+	s.router = mux.NewRouter()
+	s.router.HandleFunc("/api/orders/{number}", s.getOrderHandler).Methods("GET")
+	s.router.HandleFunc("/api/orders", s.registerOrderHandler).Methods("POST")
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Register регистрирует заказ, отсчет статусов начинается с этого момента. Повторная регистрация ничего не меняет
+func (s *Server) Register(number string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.registered[number]; !ok {
+		s.registered[number] = s.cfg.Now()
+	}
+}
+
+// DefaultAccrual начисление по умолчанию: сумма цифр номера, умноженная на 10
+func DefaultAccrual(number string) float64 {
+	sum := 0
+	for _, digit := range number {
+		if digit >= '0' && digit <= '9' {
+			sum += int(digit - '0')
+		}
+	}
+	return float64(sum * 10)
+}
+
+// ParseRules разбирает правила вида "prefix=INVALID,prefix=PROCESSED:500", PROCESSED без суммы - начисление по умолчанию
+func ParseRules(value string) ([]Rule, error) {
+	var rules []Rule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, result, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("rule %q: want prefix=STATUS[:accrual]", item)
+		}
+		status, accrualValue, hasAccrual := strings.Cut(result, ":")
+		rule := Rule{Prefix: prefix, Status: strings.ToUpper(status)}
+		if rule.Status != "PROCESSED" && rule.Status != "INVALID" {
+			return nil, fmt.Errorf("rule %q: final status must be PROCESSED or INVALID", item)
+		}
+		if hasAccrual {
+			accrual, err := strconv.ParseFloat(accrualValue, 64)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", item, err)
+			}
+			rule.Accrual = accrual
+		} else if rule.Status == "PROCESSED" {
+			rule.Accrual = -1
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// result окончательный результат расчета заказа
+func (s *Server) result(number string) (string, float64) {
+	for _, rule := range s.cfg.Rules {
+		if strings.HasPrefix(number, rule.Prefix) {
+			if rule.Status == "PROCESSED" && rule.Accrual < 0 {
+				return rule.Status, DefaultAccrual(number)
+			}
+			return rule.Status, rule.Accrual
+		}
+	}
+	return "PROCESSED", DefaultAccrual(number)
+}
+
+// allow считает запрос в текущей минуте, false - лимит исчерпан, вторым значением время до конца минуты
+func (s *Server) allow(now time.Time) (bool, time.Duration) {
+	if s.cfg.RateLimit <= 0 {
+		return true, 0
+	}
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.requests = 0
+	}
+	if s.requests >= s.cfg.RateLimit {
+		return false, s.windowStart.Add(time.Minute).Sub(now)
+	}
+	s.requests++
+	return true, 0
+}
+
+func (s *Server) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	number := mux.Vars(r)["number"]
+
+	s.mu.Lock()
+	now := s.cfg.Now()
+	allowed, retryAfter := s.allow(now)
+	if !allowed {
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.cfg.RateLimit)
+		return
+	}
+	registeredAt, ok := s.registered[number]
+	if !ok && s.cfg.AutoRegister && service.IsValidLuhn(number) {
+		registeredAt, ok = now, true
+		s.registered[number] = now
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	response := models.AccrualResponse{Order: number}
+	elapsed := now.Sub(registeredAt)
+	switch {
+	case elapsed < s.cfg.RegisteredFor:
+		response.Status = "REGISTERED"
+	case elapsed < s.cfg.RegisteredFor+s.cfg.ProcessingFor:
+		response.Status = "PROCESSING"
+	default:
+		response.Status, response.Accrual = s.result(number)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) registerOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Order string `json:"order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Order == "" {
+		http.Error(w, "order is required", http.StatusBadRequest)
+		return
+	}
+	if !service.IsValidLuhn(request.Order) {
+		http.Error(w, "invalid order number", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.registered[request.Order]; exists {
+		http.Error(w, "order is already registered", http.StatusConflict)
+		return
+	}
+	s.registered[request.Order] = s.cfg.Now()
+	w.WriteHeader(http.StatusAccepted)
+}
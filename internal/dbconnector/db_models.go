@@ -1,6 +1,8 @@
 package dbconnector
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -9,6 +11,15 @@ type User struct {
 	Email    string  `json:"login" gorm:"unique;not null"`
 	Password string  `json:"password" gorm:"not null"`
 	Balance  float64 `gorm:"default:0"`
+	Role     string  `json:"-" gorm:"not null;default:'user'"`
+	// почта еще не подтверждена, пока так - списывать баллы нельзя
+	EmailUnverified bool `json:"-" gorm:"default:false"`
+	// subject пользователя у OIDC провайдера, если он входил через SSO
+	OIDCSubject *string `json:"-" gorm:"column:oidc_subject;unique"`
+	// второй фактор: секрет TOTP появляется при подключении, но действует только после подтверждения кодом
+	TOTPSecret      string `json:"-"`
+	TOTPEnabled     bool   `json:"-" gorm:"default:false"`
+	TOTPLastCounter int64  `json:"-" gorm:"default:0"`
 }
 
 type Order struct {
@@ -18,6 +29,14 @@ type Order struct {
 	Points float64 `gorm:"default:0"`
 	UserID uint
 	User   User
+	// когда снова спрашивать accrual о заказе и сколько раз уже спросили без результата
+	NextCheckAt *time.Time `gorm:"index"`
+	Attempts    int        `gorm:"default:0"`
+	// какой экземпляр сервиса сейчас проверяет заказ и до какого времени, чтобы реплики не проверяли его дважды
+	LeaseOwner  string `gorm:"index"`
+	LeasedUntil *time.Time
+	// баллы за заказ уже зачислены на баланс, второй раз не начисляем
+	Credited bool `gorm:"default:false"`
 }
 
 type Withdrawal struct {
@@ -26,3 +45,65 @@ type Withdrawal struct {
 	UserID uint    `gorm:"not null"`
 	Number string  `gorm:"not null"`
 }
+
+type Session struct {
+	gorm.Model
+	UserID     uint `gorm:"not null;index"`
+	Device     string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+// OneTimeToken одноразовый токен (например для сброса пароля), в базе храним только его хеш
+type OneTimeToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Purpose   string `gorm:"not null"`
+	TokenHash string `gorm:"unique;not null"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// LoginThrottle счетчик неудачных входов по ключу (логин или IP)
+type LoginThrottle struct {
+	gorm.Model
+	Key           string `gorm:"unique;not null"`
+	Failures      int    `gorm:"default:0"`
+	LastFailureAt time.Time
+}
+
+// RecoveryCode одноразовый резервный код на случай потери аутентификатора, храним только хеш
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null"`
+	UsedAt   *time.Time
+}
+
+// APIKey ключ для партнеров и машинных клиентов, сам ключ показываем один раз, в базе только хеш
+type APIKey struct {
+	gorm.Model
+	UserID     uint `gorm:"not null;index"`
+	Name       string
+	Prefix     string `gorm:"not null"`
+	KeyHash    string `gorm:"unique;not null"`
+	Scopes     string `gorm:"not null"`
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// SecurityEvent запись журнала безопасности: попытки входа и новые сессии.
+// Для неудачного входа с неизвестным логином UserID = 0, но логин сохраняем
+type SecurityEvent struct {
+	gorm.Model
+	UserID    uint `gorm:"index"`
+	Login     string
+	Type      string `gorm:"not null"`
+	Success   bool
+	Detail    string
+	IP        string
+	UserAgent string
+}
@@ -2,11 +2,16 @@ package dbconnector
 
 import (
 	"context"
+	stderrors "errors"
 	"log"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/theheadmen/goDipl2/internal/errors"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DBConnector struct {
@@ -19,7 +24,7 @@ func OpenDBConnect(dsn string) (*DBConnector, error) {
 }
 
 func (dbConnector *DBConnector) DBInitialize() error {
-	return dbConnector.DB.AutoMigrate(&User{}, &Order{}, &Withdrawal{})
+	return dbConnector.DB.AutoMigrate(&User{}, &Order{}, &Withdrawal{}, &Session{}, &OneTimeToken{}, &LoginThrottle{}, &RecoveryCode{}, &APIKey{}, &SecurityEvent{})
 }
 
 func (dbConnector *DBConnector) GetUserByEmail(ctx context.Context, email string) (User, error) {
@@ -28,6 +33,12 @@ func (dbConnector *DBConnector) GetUserByEmail(ctx context.Context, email string
 	return checkedUser, result.Error
 }
 
+func (dbConnector *DBConnector) GetUserByOIDCSubject(ctx context.Context, subject string) (User, error) {
+	var checkedUser User
+	result := dbConnector.DB.WithContext(ctx).Where("oidc_subject = ?", subject).First(&checkedUser)
+	return checkedUser, result.Error
+}
+
 func (dbConnector *DBConnector) GetUserByUserID(ctx context.Context, userID uint) (User, error) {
 	var user User
 	result := dbConnector.DB.First(&user, userID).WithContext(ctx)
@@ -57,18 +68,25 @@ func (dbConnector *DBConnector) AddOrder(ctx context.Context, newOrder *Order) e
 	return result.Error
 }
 
-func (dbConnector *DBConnector) UpdateOrder(ctx context.Context, updOrder *Order) error {
-	result := dbConnector.DB.Save(&updOrder).WithContext(ctx)
-	return result.Error
-}
-
+// AddUser заводит пользователя, если логин уже занят - errors.ErrLoginTaken
 func (dbConnector *DBConnector) AddUser(ctx context.Context, newUser *User) error {
 	result := dbConnector.DB.Create(&newUser).WithContext(ctx)
+	if isUniqueViolation(result.Error, "email") {
+		return errors.ErrLoginTaken
+	}
 	return result.Error
 }
 
-func (dbConnector *DBConnector) UpdateUser(ctx context.Context, updUser *User) error {
-	result := dbConnector.DB.Save(&updUser).WithContext(ctx)
+// isUniqueViolation ошибка postgres о нарушении уникальности по ограничению, в имени которого есть column
+func isUniqueViolation(err error, column string) bool {
+	var pgErr *pgconn.PgError
+	return stderrors.As(err, &pgErr) && pgErr.Code == "23505" && strings.Contains(pgErr.ConstraintName, column)
+}
+
+// UpdateUserFields сохраняет только перечисленные поля пользователя, например Password.
+// Остальные поля в копии пользователя могли устареть, их не перезаписываем
+func (dbConnector *DBConnector) UpdateUserFields(ctx context.Context, updUser *User, fields ...string) error {
+	result := dbConnector.DB.WithContext(ctx).Model(updUser).Select(fields).Updates(updUser)
 	return result.Error
 }
 
@@ -103,17 +121,136 @@ func (dbConnector *DBConnector) GetAddWithdrawalsByUserID(ctx context.Context, u
 	return withdrawals, result.Error
 }
 
-func (dbConnector *DBConnector) GetWaitingOrders(ctx context.Context) ([]Order, error) {
+// ScheduleOrderCheck сохраняет только расписание проверок, статус и баллы не трогаем
+func (dbConnector *DBConnector) ScheduleOrderCheck(ctx context.Context, order *Order) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&Order{}).Where("id = ?", order.ID).
+		Updates(map[string]interface{}{"attempts": order.Attempts, "next_check_at": order.NextCheckAt})
+	return result.Error
+}
+
+// ClaimDueOrders берет в аренду до limit заказов, которым пора в accrual и которые никто не проверяет.
+// Строки, заблокированные другой репликой, пропускаем, так что реплики разбирают разные заказы и не ждут друг друга
+func (dbConnector *DBConnector) ClaimDueOrders(ctx context.Context, owner string, now time.Time, leaseFor time.Duration, limit int) ([]Order, error) {
+	tx := dbConnector.DB.WithContext(ctx).Begin()
+
 	var orders []Order
-	result := dbConnector.DB.Where("status = 'REGISTERED' OR status = 'PROCESSING' OR status = 'NEW'").Find(&orders).WithContext(ctx)
-	return orders, result.Error
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: clause.LockingOptionsSkipLocked}).
+		Where("status IN ('REGISTERED', 'PROCESSING', 'NEW') AND (next_check_at IS NULL OR next_check_at <= ?) AND (leased_until IS NULL OR leased_until <= ?)", now, now).
+		Order("next_check_at NULLS FIRST, id").Limit(limit).Find(&orders)
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+	if len(orders) == 0 {
+		tx.Rollback()
+		return orders, nil
+	}
+
+	leasedUntil := now.Add(leaseFor)
+	ids := make([]uint, 0, len(orders))
+	for i := range orders {
+		orders[i].LeaseOwner = owner
+		orders[i].LeasedUntil = &leasedUntil
+		ids = append(ids, orders[i].ID)
+	}
+	result = tx.Model(&Order{}).Where("id IN ?", ids).
+		Updates(map[string]interface{}{"lease_owner": owner, "leased_until": leasedUntil})
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+
+	tx.Commit()
+	return orders, nil
+}
+
+// ApplyAccrualResult в одной транзакции сохраняет результат проверки заказа и, если заказ обработан,
+// зачисляет баллы на баланс. Сохраняем, только если аренда все еще у owner, false - аренду перехватила
+// другая реплика и результат этой проверки не применяем. Баллы за заказ зачисляются ровно один раз
+func (dbConnector *DBConnector) ApplyAccrualResult(ctx context.Context, order *Order, owner string) (bool, error) {
+	tx := dbConnector.DB.WithContext(ctx).Begin()
+
+	result := tx.Model(&Order{}).Where("id = ? AND lease_owner = ?", order.ID, owner).
+		Updates(map[string]interface{}{
+			"status":        order.Status,
+			"points":        order.Points,
+			"attempts":      order.Attempts,
+			"next_check_at": order.NextCheckAt,
+		})
+	if result.Error != nil {
+		tx.Rollback()
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if order.Status == "PROCESSED" && order.Points > 0 {
+		// флаг ставит только одна транзакция, остальные ждут ее на блокировке строки и не найдут заказ
+		result = tx.Model(&Order{}).Where("id = ? AND credited = false", order.ID).Update("credited", true)
+		if result.Error != nil {
+			tx.Rollback()
+			return false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			// баланс увеличиваем в базе, а не в прочитанной копии, чтобы не потерять параллельные списания
+			result = tx.Model(&User{}).Where("id = ?", order.UserID).Update("balance", gorm.Expr("balance + ?", order.Points))
+			if result.Error != nil {
+				tx.Rollback()
+				return false, result.Error
+			}
+			order.Credited = true
+		}
+	}
+
+	tx.Commit()
+	return true, nil
+}
+
+// ClaimOrder берет в аренду заказ по номеру, в каком бы статусе он ни был, свою аренду owner продлевает.
+// false - заказ сейчас проверяет кто-то другой. Заказа нет - gorm.ErrRecordNotFound
+func (dbConnector *DBConnector) ClaimOrder(ctx context.Context, number string, owner string, now time.Time, leaseFor time.Duration) (Order, bool, error) {
+	tx := dbConnector.DB.WithContext(ctx).Begin()
+
+	var order Order
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", number).First(&order)
+	if result.Error != nil {
+		tx.Rollback()
+		return order, false, result.Error
+	}
+	if order.LeaseOwner != "" && order.LeaseOwner != owner && order.LeasedUntil != nil && order.LeasedUntil.After(now) {
+		tx.Rollback()
+		return order, false, nil
+	}
+
+	leasedUntil := now.Add(leaseFor)
+	order.LeaseOwner = owner
+	order.LeasedUntil = &leasedUntil
+	result = tx.Model(&Order{}).Where("id = ?", order.ID).
+		Updates(map[string]interface{}{"lease_owner": owner, "leased_until": leasedUntil})
+	if result.Error != nil {
+		tx.Rollback()
+		return order, false, result.Error
+	}
+
+	tx.Commit()
+	return order, true, nil
+}
+
+// ReleaseOrders снимает все аренды owner, например когда цикл проверки закончился или прервался
+func (dbConnector *DBConnector) ReleaseOrders(ctx context.Context, owner string) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&Order{}).Where("lease_owner = ?", owner).
+		Updates(map[string]interface{}{"lease_owner": "", "leased_until": nil})
+	return result.Error
 }
 
 func (dbConnector *DBConnector) WithdrawalTransaction(ctx context.Context, order *Order, withdrawal *Withdrawal, user *User, userEmail string, requestedSum float64) error {
-	tx := dbConnector.DB.Begin()
+	tx := dbConnector.DB.WithContext(ctx).Begin()
 
-	// мы знаем что такой пользователь есть, конкретно здесь нас интересует его баланс
-	result := tx.Where("email = ?", userEmail).First(&user).WithContext(ctx)
+	// мы знаем что такой пользователь есть, конкретно здесь нас интересует его баланс.
+	// Блокируем строку до конца транзакции, чтобы параллельные списания и начисления шли по очереди
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email = ?", userEmail).First(&user)
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
@@ -126,19 +263,262 @@ func (dbConnector *DBConnector) WithdrawalTransaction(ctx context.Context, order
 	// иначе обновляем баланс, и отправляем заказ и списание
 	user.Balance -= requestedSum
 
-	result = tx.Create(&order).WithContext(ctx)
+	result = tx.Create(&order)
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
 	}
 
-	result = tx.Create(&withdrawal).WithContext(ctx)
+	result = tx.Create(&withdrawal)
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
 	}
 
-	result = tx.Save(&user).WithContext(ctx)
+	// меняем только баланс, остальные поля пользователя могли обновиться в другом запросе
+	result = tx.Model(&User{}).Where("id = ?", user.ID).Update("balance", gorm.Expr("balance - ?", requestedSum))
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	tx.Commit()
+	return nil
+}
+
+func (dbConnector *DBConnector) AddSession(ctx context.Context, session *Session) error {
+	result := dbConnector.DB.WithContext(ctx).Create(&session)
+	return result.Error
+}
+
+func (dbConnector *DBConnector) GetSessionByID(ctx context.Context, sessionID uint) (Session, error) {
+	var session Session
+	result := dbConnector.DB.WithContext(ctx).First(&session, sessionID)
+	return session, result.Error
+}
+
+// GetActiveSessionsByUserID возвращает не отозванные и не просроченные сессии пользователя
+func (dbConnector *DBConnector) GetActiveSessionsByUserID(ctx context.Context, userID uint) ([]Session, error) {
+	var sessions []Session
+	result := dbConnector.DB.WithContext(ctx).Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).Order("created_at").Find(&sessions)
+	return sessions, result.Error
+}
+
+func (dbConnector *DBConnector) TouchSession(ctx context.Context, sessionID uint, lastSeenAt time.Time) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&Session{}).Where("id = ?", sessionID).Update("last_seen_at", lastSeenAt)
+	return result.Error
+}
+
+// RevokeSession отзывает сессию, но только если она принадлежит этому пользователю
+func (dbConnector *DBConnector) RevokeSession(ctx context.Context, sessionID uint, userID uint) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeUserSessions отзывает все сессии пользователя, кроме exceptSessionID
+func (dbConnector *DBConnector) RevokeUserSessions(ctx context.Context, userID uint, exceptSessionID uint) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, exceptSessionID).
+		Update("revoked_at", time.Now())
+	return result.Error
+}
+
+func (dbConnector *DBConnector) AddOneTimeToken(ctx context.Context, token *OneTimeToken) error {
+	result := dbConnector.DB.WithContext(ctx).Create(&token)
+	return result.Error
+}
+
+// UseOneTimeToken помечает токен использованным и возвращает его.
+// Проверка и пометка делаются одним запросом, так что один токен нельзя использовать дважды
+// GetOneTimeToken находит действующий токен, но не использует его, например чтобы проверить запрос до использования
+func (dbConnector *DBConnector) GetOneTimeToken(ctx context.Context, purpose string, tokenHash string) (OneTimeToken, error) {
+	var token OneTimeToken
+	result := dbConnector.DB.WithContext(ctx).
+		Where("purpose = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", purpose, tokenHash, time.Now()).
+		First(&token)
+	if result.Error == gorm.ErrRecordNotFound {
+		return token, errors.ErrInvalidOneTimeToken
+	}
+	return token, result.Error
+}
+
+func (dbConnector *DBConnector) UseOneTimeToken(ctx context.Context, purpose string, tokenHash string) (OneTimeToken, error) {
+	var token OneTimeToken
+	now := time.Now()
+	result := dbConnector.DB.WithContext(ctx).Model(&token).Clauses(clause.Returning{}).
+		Where("purpose = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", purpose, tokenHash, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return token, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return token, errors.ErrInvalidOneTimeToken
+	}
+	return token, nil
+}
+
+func (dbConnector *DBConnector) GetLoginThrottles(ctx context.Context, keys []string) ([]LoginThrottle, error) {
+	var throttles []LoginThrottle
+	result := dbConnector.DB.WithContext(ctx).Where("key IN ?", keys).Find(&throttles)
+	return throttles, result.Error
+}
+
+// AddLoginFailure атомарно увеличивает счетчик неудач по ключу.
+// Если последняя неудача была раньше resetBefore, счетчик начинается заново
+func (dbConnector *DBConnector) AddLoginFailure(ctx context.Context, key string, now time.Time, resetBefore time.Time) (LoginThrottle, error) {
+	throttle := LoginThrottle{Key: key, Failures: 1, LastFailureAt: now}
+	result := dbConnector.DB.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"failures":        gorm.Expr("CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END", resetBefore),
+				"last_failure_at": now,
+				"updated_at":      now,
+			}),
+		},
+		clause.Returning{},
+	).Create(&throttle)
+	return throttle, result.Error
+}
+
+func (dbConnector *DBConnector) ResetLoginFailures(ctx context.Context, key string) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&LoginThrottle{}).Where("key = ?", key).Update("failures", 0)
+	return result.Error
+}
+
+// UseTOTPCounter запоминает интервал последнего принятого TOTP кода, код из того же или более старого интервала уже не пройдет
+func (dbConnector *DBConnector) UseTOTPCounter(ctx context.Context, userID uint, counter int64) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", userID, counter).
+		Update("totp_last_counter", counter)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes удаляет старые резервные коды пользователя и сохраняет новые
+func (dbConnector *DBConnector) ReplaceRecoveryCodes(ctx context.Context, userID uint, codeHashes []string) error {
+	tx := dbConnector.DB.WithContext(ctx).Begin()
+
+	result := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	for _, codeHash := range codeHashes {
+		result = tx.Create(&RecoveryCode{UserID: userID, CodeHash: codeHash})
+		if result.Error != nil {
+			tx.Rollback()
+			return result.Error
+		}
+	}
+
+	tx.Commit()
+	return nil
+}
+
+func (dbConnector *DBConnector) UseRecoveryCode(ctx context.Context, userID uint, codeHash string) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+func (dbConnector *DBConnector) AddAPIKey(ctx context.Context, apiKey *APIKey) error {
+	result := dbConnector.DB.WithContext(ctx).Create(&apiKey)
+	return result.Error
+}
+
+func (dbConnector *DBConnector) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	var apiKey APIKey
+	result := dbConnector.DB.WithContext(ctx).Where("key_hash = ?", keyHash).First(&apiKey)
+	return apiKey, result.Error
+}
+
+func (dbConnector *DBConnector) GetAPIKeysByUserID(ctx context.Context, userID uint) ([]APIKey, error) {
+	var apiKeys []APIKey
+	result := dbConnector.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&apiKeys)
+	return apiKeys, result.Error
+}
+
+func (dbConnector *DBConnector) TouchAPIKey(ctx context.Context, keyID uint, lastUsedAt time.Time) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&APIKey{}).Where("id = ?", keyID).Update("last_used_at", lastUsedAt)
+	return result.Error
+}
+
+// RevokeAPIKey отзывает ключ, но только если он принадлежит этому пользователю
+func (dbConnector *DBConnector) RevokeAPIKey(ctx context.Context, keyID uint, userID uint) error {
+	result := dbConnector.DB.WithContext(ctx).Model(&APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (dbConnector *DBConnector) AddSecurityEvent(ctx context.Context, event *SecurityEvent) error {
+	result := dbConnector.DB.WithContext(ctx).Create(event)
+	return result.Error
+}
+
+// GetSecurityEventsByUserID события пользователя от новых к старым, постранично
+func (dbConnector *DBConnector) GetSecurityEventsByUserID(ctx context.Context, userID uint, limit int, offset int) ([]SecurityEvent, error) {
+	var events []SecurityEvent
+	result := dbConnector.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created_at desc, id desc").Limit(limit).Offset(offset).Find(&events)
+	return events, result.Error
+}
+
+// PurgeUserData удаляет все, что связано с входом пользователя (сессии, токены, ключи, журнал, счетчик неудач)
+// и сохраняет обезличенного пользователя. Заказы и списания не трогаем, они нужны для учета
+func (dbConnector *DBConnector) PurgeUserData(ctx context.Context, user *User, loginEmail string, throttleKey string) error {
+	tx := dbConnector.DB.WithContext(ctx).Begin()
+
+	for _, model := range []interface{}{&Session{}, &OneTimeToken{}, &RecoveryCode{}, &APIKey{}} {
+		result := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model)
+		if result.Error != nil {
+			tx.Rollback()
+			return result.Error
+		}
+	}
+
+	// неудачные входы под этим логином могли записаться еще без user_id
+	result := tx.Unscoped().Where("user_id = ? OR login = ?", user.ID, loginEmail).Delete(&SecurityEvent{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	result = tx.Unscoped().Where("key = ?", throttleKey).Delete(&LoginThrottle{})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// сохраняем только обезличенные поля, баланс и остальное не трогаем
+	result = tx.Model(user).Select("Email", "Password", "TOTPSecret", "TOTPEnabled", "OIDCSubject").Updates(user)
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
@@ -151,8 +531,50 @@ func (dbConnector *DBConnector) WithdrawalTransaction(ctx context.Context, order
 func (dbConnector *DBConnector) DeleteAllData(ctx context.Context) error {
 	tx := dbConnector.DB.Begin()
 
+	// Delete all data from the SecurityEvent table
+	result := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&SecurityEvent{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// Delete all data from the APIKey table
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&APIKey{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// Delete all data from the RecoveryCode table
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&RecoveryCode{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// Delete all data from the LoginThrottle table
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&LoginThrottle{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// Delete all data from the OneTimeToken table
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&OneTimeToken{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// Delete all data from the Session table
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&Session{}).WithContext(ctx)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
 	// Delete all data from the Withdrawal table
-	result := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&Withdrawal{}).WithContext(ctx)
+	result = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&Withdrawal{}).WithContext(ctx)
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
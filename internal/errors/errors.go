@@ -1,10 +1,57 @@
 package errors
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 var (
 	ErrAlreadyHaveOrder             = fmt.Errorf("we already have order")
 	ErrAlreadyHaveOrderForOtherUser = fmt.Errorf("already have order for other user")
 	ErrInsufficientFunds            = fmt.Errorf("insufficient funds")
 	ErrInvalidOrderNumber           = fmt.Errorf("invalid order number format")
+	ErrInvalidToken                 = fmt.Errorf("invalid session token")
+	ErrTokenExpired                 = fmt.Errorf("session token expired")
+	ErrSessionNotFound              = fmt.Errorf("session not found")
+	ErrSessionRevoked               = fmt.Errorf("session revoked")
+	ErrInvalidOneTimeToken          = fmt.Errorf("invalid or expired token")
+	ErrInvalidTOTPCode              = fmt.Errorf("invalid two-factor code")
+	ErrTOTPRequired                 = fmt.Errorf("two-factor code required")
+	ErrTOTPAlreadyEnabled           = fmt.Errorf("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled              = fmt.Errorf("two-factor authentication is not enrolled")
+	ErrInvalidAPIKey                = fmt.Errorf("invalid api key")
+	ErrAPIKeyNotFound               = fmt.Errorf("api key not found")
+	ErrInvalidScope                 = fmt.Errorf("unknown or empty api key scope")
+	ErrInsufficientScope            = fmt.Errorf("api key does not have required scope")
+	ErrUserNotFound                 = fmt.Errorf("user not found")
+	ErrInvalidRole                  = fmt.Errorf("unknown role")
+	ErrForbidden                    = fmt.Errorf("not enough permissions")
+	ErrPasswordTooShort             = fmt.Errorf("password is too short")
+	ErrPasswordEqualsLogin          = fmt.Errorf("password must not match login")
+	ErrPasswordDenied               = fmt.Errorf("password is too common")
+	ErrEmailNotVerified             = fmt.Errorf("email is not verified")
+	ErrEmailAlreadyVerified         = fmt.Errorf("email is already verified")
+	ErrOIDCAlreadyLinked            = fmt.Errorf("account is already linked to another sso identity")
+	ErrLoginTaken                   = fmt.Errorf("login is already taken")
+	ErrOIDCState                    = fmt.Errorf("invalid or missing sso state")
+	ErrInvalidIDToken               = fmt.Errorf("invalid id token")
+	ErrUnknownOIDCKey               = fmt.Errorf("id token signed with unknown key")
+	ErrInvalidCSRFToken             = fmt.Errorf("invalid or missing csrf token")
+	ErrUnknownOrderStatus           = fmt.Errorf("unknown order status")
+	ErrIllegalOrderStatusTransition = fmt.Errorf("illegal order status transition")
 )
+
+// LockedOutError вход временно заблокирован из-за подбора пароля
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter)
+}
+
+// RetryAfterSeconds значение для заголовка Retry-After, округленное вверх
+func (e *LockedOutError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
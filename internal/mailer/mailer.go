@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer отправляет письма пользователям, реализация выбирается в конфиге
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// WriterMailer пишет письма в io.Writer, подходит для локальной разработки (stdout или файл)
+type WriterMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{w: w}
+}
+
+// NewFileMailer дописывает письма в конец файла
+func NewFileMailer(path string) (*WriterMailer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterMailer(file), nil
+}
+
+func (m *WriterMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	return err
+}
+
+// SMTPMailer отправляет письма через SMTP сервер, авторизация нужна только если задан Username
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	return &SMTPMailer{Addr: addr, From: from, Username: username, Password: password}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host := m.Addr
+		if idx := strings.LastIndex(host, ":"); idx != -1 {
+			host = host[:idx]
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.From, to, subject, time.Now().Format(time.RFC1123Z), body)
+
+	// net/smtp не умеет в контекст, поэтому хотя бы не начинаем отправку отмененного запроса
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(message))
+}
@@ -19,6 +19,22 @@ type BalanceResponse struct {
 type WithdrawRequest struct {
 	Order string  `json:"order"`
 	Sum   float64 `json:"sum"`
+	// код второго фактора, нужен только для крупных списаний
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
 }
 
 type WithdrawalResponse struct {
@@ -32,3 +48,106 @@ type AccrualResponse struct {
 	Status  string  `json:"status"`
 	Accrual float64 `json:"accrual,omitempty"`
 }
+
+// AccrualWebhookResult что стало с одним результатом, который прислал accrual:
+// applied, not_found (нет такого заказа), busy (заказ сейчас проверяется, результат придет опросом)
+// или rejected (недопустимый или неизвестный статус)
+type AccrualWebhookResult struct {
+	Order  string `json:"order"`
+	Result string `json:"result"`
+}
+
+type SessionResponse struct {
+	ID         uint      `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPConfirmResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFARequiredResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type APIKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// сам ключ отдаем только в ответе на создание
+	Key string `json:"key,omitempty"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+type EmailConfirmRequest struct {
+	Token string `json:"token"`
+}
+
+type SecurityEventResponse struct {
+	Type      string    `json:"type"`
+	Success   bool      `json:"success"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	// токен из письма, подтверждает удаление вместо пароля (например, у пользователя, пришедшего через SSO)
+	Token string `json:"token,omitempty"`
+}
+
+type ProfileExport struct {
+	ID            uint      `json:"id"`
+	Login         string    `json:"login"`
+	Role          string    `json:"role"`
+	Balance       float64   `json:"balance"`
+	EmailVerified bool      `json:"email_verified"`
+	TOTPEnabled   bool      `json:"totp_enabled"`
+	SSOLinked     bool      `json:"sso_linked"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// UserExport все, что мы храним о пользователе, в одном документе
+type UserExport struct {
+	ExportedAt     time.Time               `json:"exported_at"`
+	Profile        ProfileExport           `json:"profile"`
+	Orders         []OrderResponse         `json:"orders"`
+	Withdrawals    []WithdrawalResponse    `json:"withdrawals"`
+	Sessions       []SessionResponse       `json:"sessions"`
+	SecurityEvents []SecurityEventResponse `json:"security_events"`
+}
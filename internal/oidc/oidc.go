@@ -0,0 +1,296 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+// jwksRefetchInterval из-за неизвестного kid перечитываем JWKS не чаще этого,
+// иначе каждый поддельный id_token превращался бы в запрос к провайдеру
+const jwksRefetchInterval = time.Minute
+
+// Identity то, что мы узнали о пользователе из проверенного id_token
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider клиент OpenID Connect провайдера для authorization code flow.
+// Адреса берутся из discovery документа, ключи подписи - из JWKS и кешируются до появления неизвестного kid,
+// но перечитываются не чаще jwksRefetchInterval
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+	client        *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider читает discovery документ провайдера issuer
+func NewProvider(ctx context.Context, issuer string, clientID string, clientSecret string, redirectURL string) (*Provider, error) {
+	p := &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var doc discoveryDocument
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	// провайдер обязан отдавать ровно тот issuer, по которому его нашли
+	if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+	p.authEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+	return p, nil
+}
+
+// AuthCodeURL адрес, на который отправляем браузер пользователя для входа у провайдера
+func (p *Provider) AuthCodeURL(state string, nonce string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.RedirectURL},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authEndpoint + separator + query.Encode()
+}
+
+// Exchange меняет code на токены и возвращает проверенную личность пользователя
+func (p *Provider) Exchange(ctx context.Context, code string, nonce string) (Identity, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Identity{}, fmt.Errorf("oidc token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return Identity{}, err
+	}
+	return p.Verify(ctx, tokenResponse.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	Expiry        int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+}
+
+// Verify проверяет подпись RS256, issuer, audience, срок жизни и nonce id_token
+func (p *Provider) Verify(ctx context.Context, rawIDToken string, nonce string) (Identity, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.ErrInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, errors.ErrInvalidIDToken
+	}
+	// принимаем только RS256, иначе можно подсунуть alg=none
+	if header.Alg != "RS256" {
+		return Identity{}, fmt.Errorf("%w: unsupported alg %q", errors.ErrInvalidIDToken, header.Alg)
+	}
+
+	key, err := p.publicKey(ctx, header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.ErrInvalidIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return Identity{}, fmt.Errorf("%w: bad signature", errors.ErrInvalidIDToken)
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, errors.ErrInvalidIDToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer {
+		return Identity{}, fmt.Errorf("%w: wrong issuer", errors.ErrInvalidIDToken)
+	}
+	if !audienceContains(claims.Audience, p.ClientID) {
+		return Identity{}, fmt.Errorf("%w: wrong audience", errors.ErrInvalidIDToken)
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return Identity{}, fmt.Errorf("%w: expired", errors.ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: wrong nonce", errors.ErrInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", errors.ErrInvalidIDToken)
+	}
+
+	return Identity{Subject: claims.Subject, Email: claims.Email, EmailVerified: claims.EmailVerified}, nil
+}
+
+// publicKey ищет ключ по kid, при промахе один раз перечитывает JWKS - провайдер мог сменить ключи.
+// Если JWKS уже перечитывали недавно, неизвестный kid сразу отклоняем
+func (p *Provider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if !p.fetchedAt.IsZero() && time.Since(p.fetchedAt) < jwksRefetchInterval {
+		return nil, errors.ErrUnknownOIDCKey
+	}
+	// время запоминаем и при ошибке, чтобы недоступный провайдер тоже не дергали на каждый токен
+	p.fetchedAt = time.Now()
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.ErrUnknownOIDCKey
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// audienceContains aud по спецификации бывает и строкой, и массивом строк
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == clientID
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err == nil {
+		for _, aud := range many {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
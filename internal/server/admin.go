@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+func (ls *ServerSystem) SetUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+
+	userID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var roleRequest models.RoleRequest
+	err = json.NewDecoder(r.Body).Decode(&roleRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = logicSystem.SetUserRoleLogic(uint(userID), roleRequest.Role)
+	if err != nil {
+		if err == errors.ErrInvalidRole {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errors.ErrUserNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) AdminGetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	targetSystem, ok := ls.targetUserLogic(w, r)
+	if !ok {
+		return
+	}
+
+	sessionResponses, err := targetSystem.GetSessionsLogic(0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessionResponses)
+}
+
+// AdminDeleteSessionHandler отзывает одну сессию пользователя, например если ее украли
+func (ls *ServerSystem) AdminDeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	targetSystem, ok := ls.targetUserLogic(w, r)
+	if !ok {
+		return
+	}
+
+	sessionID, err := strconv.ParseUint(mux.Vars(r)["sid"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := targetSystem.RevokeSessionLogic(uint(sessionID))
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminDeleteSessionsHandler отзывает все сессии пользователя
+func (ls *ServerSystem) AdminDeleteSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	targetSystem, ok := ls.targetUserLogic(w, r)
+	if !ok {
+		return
+	}
+
+	err := ls.Storage.RevokeUserSessions(r.Context(), targetSystem.User.ID, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminCreateAPIKeyHandler выпускает ключ от имени пользователя, например для его интеграции
+func (ls *ServerSystem) AdminCreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	targetSystem, ok := ls.targetUserLogic(w, r)
+	if !ok {
+		return
+	}
+
+	createAPIKey(w, r, targetSystem)
+}
+
+func (ls *ServerSystem) AdminDeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	targetSystem, ok := ls.targetUserLogic(w, r)
+	if !ok {
+		return
+	}
+
+	keyID, err := strconv.ParseUint(mux.Vars(r)["kid"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = targetSystem.RevokeAPIKeyLogic(uint(keyID))
+	if err != nil {
+		if err == errors.ErrAPIKeyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// targetUserLogic собирает LogicSystem для пользователя из {id}, чтобы админ мог действовать от его имени
+func (ls *ServerSystem) targetUserLogic(w http.ResponseWriter, r *http.Request) (*service.LogicSystem, bool) {
+	admin, _ := service.UserFromContext(r.Context())
+
+	userID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := ls.Storage.GetUserByUserID(r.Context(), uint(userID))
+	if err != nil {
+		http.Error(w, errors.ErrUserNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	log.Printf("admin %d %s %s for user %d\n", admin.ID, r.Method, r.URL.Path, user.ID)
+
+	return &service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: &user}, true
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+const (
+	sessionCookieName = "session_token"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// CookiePolicy атрибуты cookie сессии и защита от CSRF.
+// Cookie сессии всегда HttpOnly и живет столько же, сколько токен.
+// При включенном CSRF браузер получает еще и читаемую cookie csrf_token, а изменяющие запросы
+// с cookie сессии должны вернуть ее значение в заголовке X-CSRF-Token. Клиенты с Bearer токеном и API ключом не проверяются
+type CookiePolicy struct {
+	Secure   bool
+	SameSite http.SameSite
+	CSRF     bool
+}
+
+func DefaultCookiePolicy() CookiePolicy {
+	return CookiePolicy{
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		CSRF:     false,
+	}
+}
+
+// setSessionCookies выставляет cookie сессии и, если включено, cookie с CSRF токеном
+func (ls *ServerSystem) setSessionCookies(w http.ResponseWriter, token string, session *dbconnector.Session) {
+	maxAge := int(ls.Tokens.TTL().Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   ls.Cookies.Secure,
+		SameSite: ls.Cookies.SameSite,
+	})
+	if ls.Cookies.CSRF {
+		// эту cookie должен читать фронтенд, поэтому без HttpOnly
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    ls.Tokens.CSRFToken(session.ID),
+			Path:     "/",
+			MaxAge:   maxAge,
+			Secure:   ls.Cookies.Secure,
+			SameSite: ls.Cookies.SameSite,
+		})
+	}
+}
+
+// clearSessionCookies просит браузер забыть cookie сессии и CSRF
+func (ls *ServerSystem) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   ls.Cookies.Secure,
+			SameSite: ls.Cookies.SameSite,
+		})
+	}
+}
+
+// checkCSRF пропускает безопасные методы и запросы без cookie сессии, остальные сверяет с X-CSRF-Token
+func (ls *ServerSystem) checkCSRF(w http.ResponseWriter, r *http.Request, session *dbconnector.Session) bool {
+	if !ls.Cookies.CSRF {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	// токен пришел в заголовке Authorization, браузер сам его не подставит
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	if !ls.Tokens.CheckCSRF(session.ID, r.Header.Get(csrfHeaderName)) {
+		log.Printf("reject %s %s for session %d: bad csrf token\n", r.Method, r.URL.Path, session.ID)
+		http.Error(w, errors.ErrInvalidCSRFToken.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+// AuthMiddleware один раз на запрос проверяет токен и кладет пользователя и сессию в контекст.
+// Все, что зарегистрировано на роутере с этим middleware, доступно только аутентифицированным пользователям
+func (ls *ServerSystem) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, session, err := ls.AuthenticateUser(w, r)
+		if err != nil {
+			// ответ с ошибкой уже записан
+			return
+		}
+		if !ls.checkCSRF(w, r, session) {
+			return
+		}
+
+		ctx := service.ContextWithUser(r.Context(), user)
+		ctx = service.ContextWithSession(ctx, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WithScope пускает к ручке и сессии пользователя, и API ключи, у которых есть scope.
+// Ручки без WithScope API ключи не видят вообще
+func (ls *ServerSystem) WithScope(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" {
+			ls.AuthMiddleware(next).ServeHTTP(w, r)
+			return
+		}
+
+		user, apiKey, err := ls.AuthenticateAPIKey(w, r)
+		if err != nil {
+			// ответ с ошибкой уже записан
+			return
+		}
+		if !service.APIKeyHasScope(apiKey, scope) {
+			log.Printf("api key %d has no scope %s\n", apiKey.ID, scope)
+			http.Error(w, errors.ErrInsufficientScope.Error(), http.StatusForbidden)
+			return
+		}
+
+		ctx := service.ContextWithUser(r.Context(), user)
+		ctx = service.ContextWithAPIKey(ctx, apiKey)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AuthenticateAPIKey проверяет ключ из заголовка X-API-Key и находит его владельца
+func (ls *ServerSystem) AuthenticateAPIKey(w http.ResponseWriter, r *http.Request) (*dbconnector.User, *dbconnector.APIKey, error) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	apiKey, err := logicSystem.ValidateAPIKeyLogic(r.Header.Get("X-API-Key"))
+	if err != nil {
+		log.Printf("reject api key: %v\n", err)
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return &dbconnector.User{}, &apiKey, err
+	}
+
+	user, err := ls.Storage.GetUserByUserID(r.Context(), apiKey.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return &user, &apiKey, err
+	}
+
+	return &user, &apiKey, nil
+}
+
+// RequirePermission пускает к ручке только пользователей с сессией, чья роль дает permission
+func (ls *ServerSystem) RequirePermission(permission string, next http.HandlerFunc) http.Handler {
+	return ls.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := service.UserFromContext(r.Context())
+		if !service.HasPermission(user, permission) {
+			log.Printf("user %d has no permission %s\n", user.ID, permission)
+			http.Error(w, errors.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}))
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCLoginHandler отправляет пользователя к провайдеру, state и nonce запоминаем в короткоживущей cookie
+func (ls *ServerSystem) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randomHex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce,
+		Path:     "/api/user/oidc",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   ls.Cookies.Secure,
+		// провайдер возвращает пользователя обычным переходом с другого сайта, Strict cookie бы потерял
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, ls.OIDC.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+// OIDCCallbackHandler принимает code от провайдера, проверяет id_token и выдает нашу обычную сессию
+func (ls *ServerSystem) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if providerError := r.URL.Query().Get("error"); providerError != "" {
+		log.Printf("oidc provider returned error: %s\n", providerError)
+		http.Error(w, providerError, http.StatusUnauthorized)
+		return
+	}
+
+	// state из cookie и из адреса должны совпасть, иначе это чужой ответ провайдера
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, errors.ErrOIDCState.Error(), http.StatusBadRequest)
+		return
+	}
+	state, nonce, found := strings.Cut(cookie.Value, ".")
+	if !found || state == "" || state != r.URL.Query().Get("state") {
+		http.Error(w, errors.ErrOIDCState.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/user/oidc", MaxAge: -1})
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	identity, err := ls.OIDC.Exchange(r.Context(), code, nonce)
+	if err != nil {
+		log.Printf("reject oidc login: %v\n", err)
+		http.Error(w, "sso login failed", http.StatusUnauthorized)
+		return
+	}
+
+	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage}
+	respCode, err := logicSystem.OIDCLoginLogic(identity, ls.Passwords, ls.EmailVerification, clientIP(r), r.UserAgent())
+	if err != nil {
+		http.Error(w, err.Error(), respCode)
+		return
+	}
+
+	ls.finishLogin(w, r, &logicSystem)
+}
+
+func randomHex() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+// learnedRateMargin какую долю от объявленного сервисом лимита используем, чтобы не упираться в него ровно
+const learnedRateMargin = 0.9
+
+// rateLimiter token bucket, общий для всех воркеров, которые ходят в accrual.
+// Токены копятся со скоростью rate в секунду, но не больше burst, rate = 0 - без ограничения.
+// Лимитер подстраивается под сервис: узнает лимит из ответа 429 и не выдает токены до Retry-After
+type rateLimiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// newRateLimiter при rps <= 0 не ограничивает запросы, пока не узнает лимит от сервиса
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	if rps < 0 {
+		rps = 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rps, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait ждет свободный токен или отмену ctx
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		switch {
+		case now.Before(l.pausedUntil):
+			wait = l.pausedUntil.Sub(now)
+		case l.rate == 0:
+			l.mu.Unlock()
+			return ctx.Err()
+		default:
+			l.refill(now)
+			if l.tokens >= 1 {
+				l.tokens--
+				l.mu.Unlock()
+				return ctx.Err()
+			}
+			wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// LearnLimit сервис сообщил, что принимает не больше perMinute запросов в минуту.
+// Лимит только снижает скорость, настроенный вручную более строгий лимит остается
+func (l *rateLimiter) LearnLimit(perMinute int) {
+	if perMinute <= 0 {
+		return
+	}
+	learned := float64(perMinute) * learnedRateMargin / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate != 0 && l.rate <= learned {
+		return
+	}
+	l.refill(time.Now())
+	l.rate = learned
+	// при известном лимите запросы должны идти равномерно, а не пачкой
+	l.burst = 1
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	log.Printf("accrual limit is %d requests per minute, pacing at %.2f requests per second\n", perMinute, l.rate)
+}
+
+// PauseUntil не выдавать токены до момента until (Retry-After), после паузы бакет начинает с нуля
+func (l *rateLimiter) PauseUntil(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+		l.tokens = 0
+		l.last = until
+	}
+}
+
+// refill начисляет токены за прошедшее время, вызывается под mu
+func (l *rateLimiter) refill(now time.Time) {
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		l.last = now
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// learnFromTooManyRequests подстраивает лимитер под ответ 429 от accrual
+func (l *rateLimiter) learnFromTooManyRequests(result service.AccrualResult) {
+	l.LearnLimit(result.RequestsPerMinute)
+	if result.RetryAfter > 0 {
+		l.PauseUntil(time.Now().Add(result.RetryAfter))
+	}
+}
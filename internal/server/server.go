@@ -4,34 +4,143 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/theheadmen/goDipl2/internal/accrual"
 	"github.com/theheadmen/goDipl2/internal/dbconnector"
 	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/mailer"
 	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/oidc"
 	"github.com/theheadmen/goDipl2/internal/service"
 )
 
 type ServerSystem struct {
-	Storage service.Storage
-	BaseURL string
+	Storage       service.Storage
+	BaseURL       string
+	Accrual       service.AccrualClient
+	Tokens        *service.TokenManager
+	Mailer        mailer.Mailer
+	ResetTokenTTL time.Duration
+	Lockout       service.LockoutPolicy
+	Passwords     service.PasswordPolicy
+	Cookies       CookiePolicy
+	// новые пользователи должны подтвердить почту, прежде чем списывать баллы
+	EmailVerification    bool
+	VerificationTokenTTL time.Duration
+	// сколько заказов проверяем в accrual параллельно и сколько запросов в секунду себе позволяем, 0 - без ограничения
+	AccrualWorkers   int
+	AccrualRateLimit float64
+	// сколько заказов берем на проверку за один цикл и дольше какого срока не откладываем повторную проверку заказа
+	AccrualBatchSize  int
+	AccrualMaxBackoff time.Duration
+	// имя этого экземпляра сервиса в арендах заказов и на сколько берем заказы в аренду.
+	// Аренда должна быть дольше цикла проверки, иначе заказ успеет перехватить другая реплика
+	InstanceID      string
+	AccrualLeaseTTL time.Duration
+	// секрет подписи результатов, которые accrual присылает сам, пусто - прием выключен и работает только опрос
+	AccrualWebhookSecret string
+	// OIDC провайдер для входа через SSO, nil - вход только по паролю
+	OIDC *oidc.Provider
+	// списания больше этой суммы требуют код второго фактора, если он включен, 0 - не требуют
+	WithdrawTOTPThreshold float64
 }
 
-func NewServerSystem(storage service.Storage, baseURL string) *ServerSystem {
-	return &ServerSystem{Storage: storage, BaseURL: baseURL}
+func NewServerSystem(storage service.Storage, baseURL string, tokens *service.TokenManager) *ServerSystem {
+	return &ServerSystem{
+		Storage:              storage,
+		BaseURL:              baseURL,
+		Accrual:              accrual.NewClient(accrual.Config{BaseURL: baseURL, Retries: 2}),
+		Tokens:               tokens,
+		Mailer:               mailer.NewWriterMailer(os.Stdout),
+		ResetTokenTTL:        time.Hour,
+		VerificationTokenTTL: 24 * time.Hour,
+		Lockout:              service.DefaultLockoutPolicy(),
+		Passwords:            service.DefaultPasswordPolicy(),
+		AccrualBatchSize:     100,
+		AccrualMaxBackoff:    time.Hour,
+		InstanceID:           newInstanceID(),
+		AccrualLeaseTTL:      5 * time.Minute,
+	}
 }
 
-func (ls *ServerSystem) MakeServer(serverAddr string) *http.Server {
+// newInstanceID имя хоста плюс случайный суффикс: несколько реплик на одном хосте тоже различаются
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "gophermart"
+	}
+	suffix, err := randomHex()
+	if err != nil {
+		return hostname + "-" + strconv.Itoa(os.Getpid())
+	}
+	return hostname + "-" + suffix[:8]
+}
+
+// MakeRouter регистрирует все ручки, защищенные ручки висят на подроутере с AuthMiddleware
+func (ls *ServerSystem) MakeRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/api/user/register", ls.RegisterUserHandler).Methods("POST")
 	r.HandleFunc("/api/user/login", ls.LoginUserHandler).Methods("POST")
-	r.HandleFunc("/api/user/orders", ls.LoadOrderHandler).Methods("POST")
-	r.HandleFunc("/api/user/orders", ls.GetOrderHandler).Methods("GET")
-	r.HandleFunc("/api/user/balance", ls.GetBalanceHandler).Methods("GET")
-	r.HandleFunc("/api/user/balance/withdraw", ls.WithdrawHandler).Methods("POST")
-	r.HandleFunc("/api/user/withdrawals", ls.GetWithdrawalsHandler).Methods("GET")
+	r.HandleFunc("/api/user/login/2fa", ls.LoginMFAHandler).Methods("POST")
+	r.HandleFunc("/api/user/password/reset", ls.RequestPasswordResetHandler).Methods("POST")
+	r.HandleFunc("/api/user/password/reset/confirm", ls.ConfirmPasswordResetHandler).Methods("POST")
+	r.HandleFunc("/api/user/email/confirm", ls.ConfirmEmailHandler).Methods("POST")
+	// вход через SSO, только если провайдер настроен
+	if ls.OIDC != nil {
+		r.HandleFunc("/api/user/oidc/login", ls.OIDCLoginHandler).Methods("GET")
+		r.HandleFunc("/api/user/oidc/callback", ls.OIDCCallbackHandler).Methods("GET")
+	}
+	// результаты расчета от accrual, только если настроен секрет подписи
+	if ls.AccrualWebhookSecret != "" {
+		r.HandleFunc("/api/accrual/webhook", ls.AccrualWebhookHandler).Methods("POST")
+	}
+
+	// эти ручки доступны и сессиям, и API ключам с нужным scope
+	r.Handle("/api/user/orders", ls.WithScope(service.ScopeOrdersWrite, ls.LoadOrderHandler)).Methods("POST")
+	r.Handle("/api/user/orders", ls.WithScope(service.ScopeOrdersRead, ls.GetOrderHandler)).Methods("GET")
+	r.Handle("/api/user/balance", ls.WithScope(service.ScopeBalanceRead, ls.GetBalanceHandler)).Methods("GET")
+	r.Handle("/api/user/balance/withdraw", ls.WithScope(service.ScopeWithdraw, ls.WithdrawHandler)).Methods("POST")
+	r.Handle("/api/user/withdrawals", ls.WithScope(service.ScopeBalanceRead, ls.GetWithdrawalsHandler)).Methods("GET")
+
+	// админские ручки, каждая проверяет свое право
+	r.Handle("/api/admin/users/{id}/role", ls.RequirePermission(service.PermissionManageUsers, ls.SetUserRoleHandler)).Methods("PUT")
+	r.Handle("/api/admin/users/{id}/sessions", ls.RequirePermission(service.PermissionManageSessions, ls.AdminGetSessionsHandler)).Methods("GET")
+	r.Handle("/api/admin/users/{id}/sessions", ls.RequirePermission(service.PermissionManageSessions, ls.AdminDeleteSessionsHandler)).Methods("DELETE")
+	r.Handle("/api/admin/users/{id}/sessions/{sid}", ls.RequirePermission(service.PermissionManageSessions, ls.AdminDeleteSessionHandler)).Methods("DELETE")
+	r.Handle("/api/admin/users/{id}/apikeys", ls.RequirePermission(service.PermissionManageAPIKeys, ls.AdminCreateAPIKeyHandler)).Methods("POST")
+	r.Handle("/api/admin/users/{id}/apikeys/{kid}", ls.RequirePermission(service.PermissionManageAPIKeys, ls.AdminDeleteAPIKeyHandler)).Methods("DELETE")
+
+	// все что ниже доступно только аутентифицированным пользователям через сессию
+	authorized := r.NewRoute().Subrouter()
+	authorized.Use(ls.AuthMiddleware)
+	authorized.HandleFunc("/api/user/logout", ls.LogoutHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/sessions", ls.GetSessionsHandler).Methods("GET")
+	authorized.HandleFunc("/api/user/sessions/{id}", ls.DeleteSessionHandler).Methods("DELETE")
+	authorized.HandleFunc("/api/user/security/events", ls.GetSecurityEventsHandler).Methods("GET")
+	authorized.HandleFunc("/api/user/export", ls.ExportUserDataHandler).Methods("GET")
+	authorized.HandleFunc("/api/user", ls.DeleteAccountHandler).Methods("DELETE")
+	authorized.HandleFunc("/api/user/delete/request", ls.RequestAccountDeletionHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/password", ls.ChangePasswordHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/email/resend", ls.ResendEmailVerificationHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/2fa/enroll", ls.EnrollTOTPHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/2fa/confirm", ls.ConfirmTOTPHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/2fa/disable", ls.DisableTOTPHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/apikeys", ls.CreateAPIKeyHandler).Methods("POST")
+	authorized.HandleFunc("/api/user/apikeys", ls.GetAPIKeysHandler).Methods("GET")
+	authorized.HandleFunc("/api/user/apikeys/{id}", ls.DeleteAPIKeyHandler).Methods("DELETE")
+
+	return r
+}
+
+func (ls *ServerSystem) MakeServer(serverAddr string) *http.Server {
+	r := ls.MakeRouter()
 
 	server := http.Server{
 		Addr:    serverAddr,
@@ -54,20 +163,30 @@ func (ls *ServerSystem) RegisterUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 	log.Printf("try to register with email: %s, and password: %s\n", user.Email, user.Password)
 
+	// поле не приходит из json, его выставляет только сервер
+	user.EmailUnverified = ls.EmailVerification
 	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: &user}
 	// Сохраняем пользователя в базе данных
-	errorCode, err := logicSystem.RegisterUserLogic()
+	errorCode, err := logicSystem.RegisterUserLogic(ls.Passwords)
 	if err != nil {
 		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
-	// Устанавливаем cookie для аутентификации
-	http.SetCookie(w, &http.Cookie{
-		Name:  "session_token",
-		Value: user.Email, // В качестве токена используем email пользователя
-		Path:  "/",
-	})
+	if user.EmailUnverified {
+		// пользователь уже заведен, если письмо не ушло - он запросит его повторно
+		_, err = logicSystem.SendEmailVerificationLogic(ls.Mailer, ls.VerificationTokenTTL)
+		if err != nil {
+			log.Printf("can't send email verification for user %d: %v\n", user.ID, err)
+		}
+	}
+
+	// Заводим сессию и устанавливаем cookie для аутентификации
+	err = ls.startSession(w, r, &logicSystem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -82,29 +201,83 @@ func (ls *ServerSystem) LoginUserHandler(w http.ResponseWriter, r *http.Request)
 	log.Printf("try to login with email: %s, and password: %s\n", reqUser.Email, reqUser.Password)
 
 	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: &reqUser}
-	respCode, err := logicSystem.LoginUserLogic()
+	respCode, err := logicSystem.LoginUserLogic(ls.Lockout, ls.Passwords, clientIP(r), r.UserAgent())
 	if err != nil {
+		// пока вход заблокирован, подсказываем клиенту когда приходить снова
+		if lockedOut, ok := err.(*errors.LockedOutError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(lockedOut.RetryAfterSeconds()))
+		}
 		http.Error(w, err.Error(), respCode)
 		return
 	}
 
-	// Устанавливаем cookie для аутентификации
-	http.SetCookie(w, &http.Cookie{
-		Name:  "session_token",
-		Value: reqUser.Email, // В качестве токена используем email пользователя
-		Path:  "/",
-	})
+	ls.finishLogin(w, r, &logicSystem)
+}
+
+// finishLogin завершает вход проверенного пользователя: выдает сессию
+// или, если включен второй фактор, токен для второго шага
+func (ls *ServerSystem) finishLogin(w http.ResponseWriter, r *http.Request, logicSystem *service.LogicSystem) {
+	// Первый фактор пройден, но включен второй: сессию выдадим только после кода
+	if logicSystem.User.TOTPEnabled {
+		mfaToken, err := ls.Tokens.IssueMFA(logicSystem.User.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(models.MFARequiredResponse{MFARequired: true, MFAToken: mfaToken})
+		return
+	}
+
+	// Заводим сессию и устанавливаем cookie для аутентификации
+	err := ls.startSession(w, r, logicSystem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (ls *ServerSystem) LoadOrderHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := ls.AuthenticateUser(w, r)
+// LoginMFAHandler второй шаг входа для пользователей с включенным TOTP
+func (ls *ServerSystem) LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var mfaRequest models.MFALoginRequest
+	err := json.NewDecoder(r.Body).Decode(&mfaRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := ls.Tokens.ParseMFA(mfaRequest.MFAToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	log.Printf("try to pass second factor for %d\n", claims.UserID)
+
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	respCode, err := logicSystem.LoginMFALogic(claims, mfaRequest.Code, ls.Lockout, clientIP(r), r.UserAgent())
 	if err != nil {
-		// Handle the error
+		if lockedOut, ok := err.(*errors.LockedOutError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(lockedOut.RetryAfterSeconds()))
+		}
+		http.Error(w, err.Error(), respCode)
 		return
 	}
-	log.Printf("post order call for %d\n", user.ID)
+
+	err = ls.startSession(w, r, logicSystem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) LoadOrderHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("post order call for %d\n", logicSystem.User.ID)
 
 	// Читаем номер заказа из тела запроса
 	body, err := io.ReadAll(r.Body)
@@ -114,7 +287,6 @@ func (ls *ServerSystem) LoadOrderHandler(w http.ResponseWriter, r *http.Request)
 	}
 	orderNumber := string(body)
 
-	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: user}
 	err = logicSystem.LoadOrderLogic(orderNumber)
 	if err != nil {
 		if err == errors.ErrInvalidOrderNumber {
@@ -136,20 +308,15 @@ func (ls *ServerSystem) LoadOrderHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("For user %d, saved new order: %s\n", user.ID, orderNumber)
+	log.Printf("For user %d, saved new order: %s\n", logicSystem.User.ID, orderNumber)
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (ls *ServerSystem) GetOrderHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := ls.AuthenticateUser(w, r)
-	if err != nil {
-		// Handle the error
-		return
-	}
-	log.Printf("get order call for %d\n", user.ID)
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("get order call for %d\n", logicSystem.User.ID)
 
-	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: user}
 	// Конвертируем список заказов в список ответов
 	orderResponses, err := logicSystem.GetOrderLogic()
 	if err != nil {
@@ -170,13 +337,8 @@ func (ls *ServerSystem) GetOrderHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (ls *ServerSystem) GetBalanceHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := ls.AuthenticateUser(w, r)
-	if err != nil {
-		// Handle the error
-		return
-	}
-	log.Printf("get balance call for %d\n", user.ID)
-	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: user}
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("get balance call for %d\n", logicSystem.User.ID)
 	balanceResponse, err := logicSystem.GetBalanceLogic()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -190,23 +352,18 @@ func (ls *ServerSystem) GetBalanceHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (ls *ServerSystem) WithdrawHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := ls.AuthenticateUser(w, r)
-	if err != nil {
-		// Handle the error
-		return
-	}
-	log.Printf("post withdraw call for %d\n", user.ID)
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("post withdraw call for %d\n", logicSystem.User.ID)
 
 	// Декодируем JSON-запрос
 	var withdrawRequest models.WithdrawRequest
-	err = json.NewDecoder(r.Body).Decode(&withdrawRequest)
+	err := json.NewDecoder(r.Body).Decode(&withdrawRequest)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 	log.Printf("Try to minus sum: %f, for order: %s\n", withdrawRequest.Sum, withdrawRequest.Order)
-	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: user}
-	code, err := logicSystem.WithdrawLogic(withdrawRequest)
+	code, err := logicSystem.WithdrawLogic(withdrawRequest, ls.WithdrawTOTPThreshold)
 
 	if err != nil {
 		http.Error(w, err.Error(), code)
@@ -217,15 +374,10 @@ func (ls *ServerSystem) WithdrawHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (ls *ServerSystem) GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := ls.AuthenticateUser(w, r)
-	if err != nil {
-		// Handle the error
-		return
-	}
-	log.Printf("get withdraw call for %d\n", user.ID)
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("get withdraw call for %d\n", logicSystem.User.ID)
 
 	// Получаем список выводов средств пользователя
-	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage, User: user}
 	withdrawalResponses, err := logicSystem.GetWithdrawalsLogic()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -244,21 +396,459 @@ func (ls *ServerSystem) GetWithdrawalsHandler(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(withdrawalResponses)
 }
 
+func (ls *ServerSystem) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	session, _ := service.SessionFromContext(r.Context())
+	log.Printf("logout call for %d, session %d\n", logicSystem.User.ID, session.ID)
+
+	code, err := logicSystem.RevokeSessionLogic(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// просим браузер забыть cookie
+	ls.clearSessionCookies(w)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	session, _ := service.SessionFromContext(r.Context())
+	log.Printf("get sessions call for %d\n", logicSystem.User.ID)
+
+	sessionResponses, err := logicSystem.GetSessionsLogic(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Возвращаем список сессий в формате JSON, текущая сессия в нем есть всегда
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessionResponses)
+}
+
+// GetSecurityEventsHandler журнал входов и новых сессий, страница задается через limit и offset
+func (ls *ServerSystem) GetSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("get security events call for %d\n", logicSystem.User.ID)
+
+	limit, offset := 0, 0
+	var err error
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if offsetParam := r.URL.Query().Get("offset"); offsetParam != "" {
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	eventResponses, err := logicSystem.GetSecurityEventsLogic(limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(eventResponses)
+}
+
+func (ls *ServerSystem) ExportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	session, _ := service.SessionFromContext(r.Context())
+	log.Printf("export call for %d\n", logicSystem.User.ID)
+
+	export, err := logicSystem.ExportUserDataLogic(session.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="gophermart-export.json"`)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (ls *ServerSystem) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("delete account call for %d\n", logicSystem.User.ID)
+
+	var deleteRequest models.DeleteAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&deleteRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := logicSystem.DeleteAccountLogic(deleteRequest)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// сессий больше нет, просим браузер забыть и cookie
+	ls.clearSessionCookies(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) RequestAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("request account deletion call for %d\n", logicSystem.User.ID)
+
+	// токен удаления живет столько же, сколько токен сброса пароля
+	code, err := logicSystem.RequestAccountDeletionLogic(ls.Mailer, ls.ResetTokenTTL)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(code)
+}
+
+func (ls *ServerSystem) DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+
+	sessionID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("delete session %d call for %d\n", sessionID, logicSystem.User.ID)
+
+	code, err := logicSystem.RevokeSessionLogic(uint(sessionID))
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	session, _ := service.SessionFromContext(r.Context())
+	log.Printf("change password call for %d\n", logicSystem.User.ID)
+
+	var changeRequest models.ChangePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&changeRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, err := logicSystem.ChangePasswordLogic(changeRequest, session.ID, ls.Passwords)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var resetRequest models.PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&resetRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("password reset call for %s\n", resetRequest.Login)
+
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	code, err := logicSystem.RequestPasswordResetLogic(resetRequest, ls.Mailer, ls.ResetTokenTTL)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// отвечаем одинаково и для существующих, и для несуществующих логинов
+	w.WriteHeader(code)
+}
+
+func (ls *ServerSystem) ConfirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var confirmRequest models.EmailConfirmRequest
+	err := json.NewDecoder(r.Body).Decode(&confirmRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	code, err := logicSystem.ConfirmEmailLogic(confirmRequest.Token)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) ResendEmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("resend email verification call for %d\n", logicSystem.User.ID)
+
+	code, err := logicSystem.SendEmailVerificationLogic(ls.Mailer, ls.VerificationTokenTTL)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(code)
+}
+
+func (ls *ServerSystem) ConfirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var confirmRequest models.PasswordResetConfirmRequest
+	err := json.NewDecoder(r.Body).Decode(&confirmRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	code, err := logicSystem.ConfirmPasswordResetLogic(confirmRequest, ls.Passwords)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("enroll TOTP call for %d\n", logicSystem.User.ID)
+
+	enrollResponse, err := logicSystem.EnrollTOTPLogic()
+	if err != nil {
+		if err == errors.ErrTOTPAlreadyEnabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(enrollResponse)
+}
+
+func (ls *ServerSystem) ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("confirm TOTP call for %d\n", logicSystem.User.ID)
+
+	var codeRequest models.TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&codeRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	confirmResponse, err := logicSystem.ConfirmTOTPLogic(codeRequest.Code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	// резервные коды показываем один раз, в базе остаются только их хеши
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(confirmResponse)
+}
+
+func (ls *ServerSystem) DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("disable TOTP call for %d\n", logicSystem.User.ID)
+
+	var codeRequest models.TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&codeRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = logicSystem.DisableTOTPLogic(codeRequest.Code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ls *ServerSystem) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("create api key call for %d\n", logicSystem.User.ID)
+	createAPIKey(w, r, logicSystem)
+}
+
+// createAPIKey выпускает ключ для logicSystem.User по телу запроса, общая часть пользовательской и админской ручек
+func createAPIKey(w http.ResponseWriter, r *http.Request, logicSystem *service.LogicSystem) {
+	var keyRequest models.APIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&keyRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keyResponse, err := logicSystem.CreateAPIKeyLogic(keyRequest)
+	if err != nil {
+		if err == errors.ErrInvalidScope || err == errors.ErrInvalidAPIKey {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(keyResponse)
+}
+
+func (ls *ServerSystem) GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+	log.Printf("get api keys call for %d\n", logicSystem.User.ID)
+
+	keyResponses, err := logicSystem.GetAPIKeysLogic()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(keyResponses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keyResponses)
+}
+
+func (ls *ServerSystem) DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logicSystem := service.NewLogicSystem(r.Context(), ls.Storage)
+
+	keyID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("delete api key %d call for %d\n", keyID, logicSystem.User.ID)
+
+	err = logicSystem.RevokeAPIKeyLogic(uint(keyID))
+	if err != nil {
+		if err == errors.ErrAPIKeyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeTOTPError отвечает кодом, который соответствует ошибке второго фактора
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case errors.ErrInvalidTOTPCode:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.ErrTOTPAlreadyEnabled, errors.ErrTOTPNotEnrolled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startSession заводит сессию в базе, выпускает под нее подписанный токен и отдает его в cookie
+func (ls *ServerSystem) startSession(w http.ResponseWriter, r *http.Request, logicSystem *service.LogicSystem) error {
+	session, err := logicSystem.CreateSessionLogic(r.UserAgent(), clientIP(r), ls.Tokens.TTL())
+	if err != nil {
+		return err
+	}
+
+	token, err := ls.Tokens.Issue(logicSystem.User.ID, session.ID)
+	if err != nil {
+		return err
+	}
+
+	ls.setSessionCookies(w, token, &session)
+	// клиентам без cookie jar отдаем тот же токен в заголовке
+	w.Header().Set("Authorization", "Bearer "+token)
+	return nil
+}
+
 // AuthenticateUser authenticates the user and looks up the user in the database.
-func (ls *ServerSystem) AuthenticateUser(w http.ResponseWriter, r *http.Request) (*dbconnector.User, error) {
+// Вместе с пользователем возвращает сессию, через которую пришел запрос
+func (ls *ServerSystem) AuthenticateUser(w http.ResponseWriter, r *http.Request) (*dbconnector.User, *dbconnector.Session, error) {
 	// Проверяем аутентификацию пользователя
-	cookie, err := r.Cookie("session_token")
+	token, err := sessionToken(r)
+	if err != nil {
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return &dbconnector.User{}, &dbconnector.Session{}, err
+	}
+
+	// Проверяем подпись и срок жизни токена
+	claims, err := ls.Tokens.Parse(token)
 	if err != nil {
+		log.Printf("reject session token: %v\n", err)
 		http.Error(w, "User not authenticated", http.StatusUnauthorized)
-		return &dbconnector.User{}, err
+		return &dbconnector.User{}, &dbconnector.Session{}, err
+	}
+
+	// Проверяем, что сессию не отозвали
+	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage}
+	session, err := logicSystem.ValidateSessionLogic(claims)
+	if err != nil {
+		log.Printf("reject session %d: %v\n", claims.SessionID, err)
+		http.Error(w, "User not authenticated", http.StatusUnauthorized)
+		return &dbconnector.User{}, &session, err
 	}
 
 	// Ищем пользователя в базе данных
-	user, err := ls.Storage.GetUserByEmail(r.Context(), cookie.Value)
+	user, err := ls.Storage.GetUserByUserID(r.Context(), claims.UserID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusUnauthorized)
-		return &user, err
+		return &user, &session, err
+	}
+
+	return &user, &session, nil
+}
+
+// sessionToken достает токен из заголовка Authorization: Bearer, а если его нет - из cookie
+func sessionToken(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.ErrInvalidToken
+		}
+		return strings.TrimSpace(token), nil
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", err
 	}
+	return cookie.Value, nil
+}
 
-	return &user, nil
+// clientIP достает адрес клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
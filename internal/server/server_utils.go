@@ -2,136 +2,116 @@ package server
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/theheadmen/goDipl2/internal/dbconnector"
-	"github.com/theheadmen/goDipl2/internal/models"
 	"github.com/theheadmen/goDipl2/internal/service"
 )
 
-func fetchOrderInfo(ctx context.Context, storage service.Storage, ord *dbconnector.Order, baseURL string, defTimeToReturn int) (int, error) {
-	// Формируем URL запроса
-	url := fmt.Sprintf("%s/api/orders/%s", baseURL, ord.Number)
-	log.Printf("Try to fetch order: %s by url %s\n", ord.Number, url)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return defTimeToReturn, fmt.Errorf("ошибка при составлении запроса: %w", err)
+// processOrders берет в аренду ожидающие заказы, которым подошел срок проверки, не больше AccrualBatchSize за цикл.
+// Заказы разбирают AccrualWorkers параллельных воркеров, запросы к accrual идут через общий limiter.
+// Как только сервис ответил 429, отменяем запросы всех воркеров и возвращаем время, которое он попросил подождать.
+// В конце цикла аренды снимаем, непроверенные заказы сразу доступны другим репликам
+func processOrders(ctx context.Context, ls *ServerSystem, defTimeToReturn int, limiter *rateLimiter, backoff service.OrderBackoff) time.Duration {
+	storage, workers, batch := ls.Storage, ls.AccrualWorkers, ls.AccrualBatchSize
+	if batch < 1 {
+		batch = 1
 	}
-
-	req = req.WithContext(ctx)
-	// Отправляем GET-запрос
-	resp, err := http.DefaultClient.Do(req)
+	// берем заказы которые еще ждут выполнения, которые пора проверить и которые не проверяет другая реплика
+	orders, err := storage.ClaimDueOrders(ctx, ls.InstanceID, time.Now(), ls.AccrualLeaseTTL, batch)
 	if err != nil {
-		return defTimeToReturn, fmt.Errorf("ошибка при отправке запроса: %w", err)
+		fmt.Printf("ошибка при запросе ORDERS из бд: %+v", err)
+		return time.Duration(defTimeToReturn) * time.Second
 	}
-	defer resp.Body.Close()
-
-	// Проверяем код ответа
-	if resp.StatusCode == http.StatusTooManyRequests {
-		retryAfter := resp.Header.Get("Retry-After")
-		retryAfterSeconds, err := strconv.Atoi(retryAfter)
-		if err != nil {
-			return defTimeToReturn, err
+	defer func() {
+		// аренды снимаем и после остановки сервера, иначе заказы будут ждать окончания аренды
+		if err := storage.ReleaseOrders(context.WithoutCancel(ctx), ls.InstanceID); err != nil {
+			log.Printf("can't release orders leased by %s: %v\n", ls.InstanceID, err)
 		}
-		log.Println("Сервис попросил повторить запрос через", retryAfterSeconds, "секунд")
-		return retryAfterSeconds, fmt.Errorf("превышено количество запросов к сервису")
-	}
-
-	if resp.StatusCode == http.StatusInternalServerError {
-		return defTimeToReturn, fmt.Errorf("внутренняя ошибка сервера")
-	}
-
-	if resp.StatusCode == http.StatusNoContent {
-		return defTimeToReturn, fmt.Errorf("такого order нет для сервиса")
-	}
-
-	// Читаем тело ответа
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return defTimeToReturn, fmt.Errorf("ошибка при чтении тела ответа: %w", err)
-	}
-
-	// Декодируем JSON-ответ в структуру AccrualResponse
-	var orderResponse models.AccrualResponse
-	err = json.Unmarshal(body, &orderResponse)
-	if err != nil {
-		invalidJSON := string(body)
-		return defTimeToReturn, fmt.Errorf("ошибка при декодировании JSON: %w. Неправильный JSON: %s. Код ответа %d", err, invalidJSON, resp.StatusCode)
+	}()
+	if workers < 1 {
+		workers = 1
 	}
-	log.Printf("We get status %s and accrual %f\n", orderResponse.Status, orderResponse.Accrual)
 
-	// Обновляем поля в Ord
-	ord.Status = orderResponse.Status
-	ord.Points = orderResponse.Accrual
-	// Обновляем запись в базе данных
-	err = storage.UpdateOrder(ctx, ord)
-	if err != nil {
-		return defTimeToReturn, fmt.Errorf("ошибка при обновлении записи в базе данных: %w", err)
+	cycleCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var retryAfter time.Duration
+	jobs := make(chan dbconnector.Order)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ord := range jobs {
+				if limiter.Wait(cycleCtx) != nil {
+					// цикл отменен, остальные заказы просто вычитываем
+					continue
+				}
+				logicSystem := service.LogicSystem{Ctx: cycleCtx, Storage: storage}
+				result, err := logicSystem.CheckOrderLogic(ls.Accrual, &ord, ls.InstanceID, backoff)
+				if result.TooManyRequests {
+					// сервис попросил подождать: остальные воркеры должны остановиться,
+					// а ждать будем самое долгое из запрошенного
+					limiter.learnFromTooManyRequests(result)
+					mu.Lock()
+					if result.RetryAfter > retryAfter {
+						retryAfter = result.RetryAfter
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				if err != nil && cycleCtx.Err() == nil {
+					// в целом, проблема с одним заказом еще не повод не рассчитать остальные
+					fmt.Printf("Ошибка при обработке заказа %s: %+v\n", ord.Number, err)
+				}
+			}
+		}()
 	}
 
-	// Если Accrual не пустое, обновляем Balance у User
-	if orderResponse.Accrual > 0 {
-		user, err := storage.GetUserByUserID(ctx, ord.UserID)
-		if err != nil {
-			return defTimeToReturn, fmt.Errorf("ошибка при поиске пользователя: %w", err)
+	for _, ord := range orders {
+		select {
+		case jobs <- ord:
+		case <-cycleCtx.Done():
 		}
-
-		// Обновляем Balance
-		user.Balance += float64(orderResponse.Accrual)
-
-		// Обновляем запись пользователя в базе данных
-		err = storage.UpdateUser(ctx, &user)
-		if err != nil {
-			return defTimeToReturn, fmt.Errorf("ошибка при обновлении баланса пользователя: %w", err)
+		if cycleCtx.Err() != nil {
+			break
 		}
-		log.Printf("User %d now have %f\n", ord.UserID, user.Balance)
 	}
+	close(jobs)
+	wg.Wait()
 
-	/*if ord.Status == "INVALID" || ord.Status == "PROCESSED" {
-		// нужна ли здесь логика?
-		return nil
-	}*/
-
-	return defTimeToReturn, nil
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	return time.Duration(defTimeToReturn) * time.Second
 }
 
-func processOrders(ctx context.Context, storage service.Storage, baseURL string, defTimeToReturn int) time.Duration {
-	// берем все заказы которые еще ждут выполнения
-	orders, err := storage.GetWaitingOrders(ctx)
-	if err != nil {
-		fmt.Printf("ошибка при запросе ORDERS из бд: %+v", err)
-		return time.Duration(defTimeToReturn) * time.Second
-	}
+// orderCheckBaseDelay через сколько повторяем первую неудачную проверку заказа, дальше задержка растет
+const orderCheckBaseDelay = 3 * time.Second
 
-	for i := 0; i < len(orders); i++ {
-		// и проверяем каждый
-		ord := orders[i]
-		timeToResetTimer, err := fetchOrderInfo(ctx, storage, &ord, baseURL, defTimeToReturn)
-		if timeToResetTimer != defTimeToReturn {
-			// если вернулось не время по умолчанию, значит был Retry-After ответ
-			// мы можем не продолжать обрабатывать остальные заказы, сразу возвращаем время которое нас попросили подождать
-			return time.Duration(timeToResetTimer) * time.Second
-		}
-		if err != nil {
-			// в целом, проблема с одним заказом еще не повод не рассчитать остальные
-			fmt.Printf("Ошибка при обработке заказа %s: %+v\n", ord.Number, err)
-		}
+// accrualBackoff расписание повторных проверок заказов, общее для опроса и результатов от accrual
+func (ls *ServerSystem) accrualBackoff() service.OrderBackoff {
+	backoff := service.OrderBackoff{Base: orderCheckBaseDelay, Max: ls.AccrualMaxBackoff}
+	if backoff.Max < backoff.Base {
+		backoff.Max = backoff.Base
 	}
-
-	return time.Duration(defTimeToReturn) * time.Second
+	return backoff
 }
 
 func MakeGorutineToCheckOrdersByTimer(ctx context.Context, ls *ServerSystem) {
 	// если случилась ошибка не связанная с Retry-After - возвращаем время по умолчанию
 	defTimeToReturn := 3
 
+	// лимитер один на все циклы: он помнит выученный лимит сервиса, а пауза между циклами не дает лишних запросов
+	limiter := newRateLimiter(ls.AccrualRateLimit, ls.AccrualWorkers)
+	backoff := ls.accrualBackoff()
+
 	go func() {
 		ctx2 := context.Background()
 		defTimerTime := time.Duration(defTimeToReturn) * time.Second
@@ -146,7 +126,7 @@ func MakeGorutineToCheckOrdersByTimer(ctx context.Context, ls *ServerSystem) {
 				log.Println("Время проверить заказы по таймеру, заодно останавливаем таймер")
 				// мы хотим дождаться обработки всех текущих заказов, прежде чем обработать новые
 				ticker.Stop()
-				newTimeForTimer := processOrders(ctx2, ls.Storage, ls.BaseURL, defTimeToReturn)
+				newTimeForTimer := processOrders(ctx2, ls, defTimeToReturn, limiter, backoff)
 				// если случилась ошибка с Retry After, здесь будет время которое просил подождать сервер
 				// в ином случае - стандартное наше время ожидания
 				ticker.Reset(newTimeForTimer)
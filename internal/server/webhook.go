@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/models"
+	"github.com/theheadmen/goDipl2/internal/service"
+)
+
+const (
+	// accrualSignatureHeader подпись запроса: hex HMAC-SHA256 с общим секретом от "<timestamp>.<тело>",
+	// можно с префиксом "sha256="
+	accrualSignatureHeader = "X-Signature"
+	// accrualTimestampHeader время подписи в unix-секундах, входит в подпись
+	accrualTimestampHeader = "X-Timestamp"
+	// подписи старше (или новее, если часы расходятся) этого окна не принимаем, чтобы перехваченный запрос
+	// нельзя было повторить позже
+	accrualSignatureWindow = 5 * time.Minute
+	// больше результатов за раз accrual не присылает, защищаемся от огромных тел
+	maxWebhookBodySize = 1 << 20
+)
+
+// AccrualWebhookHandler принимает от accrual результаты расчета одного заказа (объект) или нескольких (массив)
+// в формате ответа GET /api/orders/{number}. Тело и время отправки должны быть подписаны общим секретом
+func (ls *ServerSystem) AccrualWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookBodySize {
+		http.Error(w, "body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	timestamp := r.Header.Get(accrualTimestampHeader)
+	if !validSignature(ls.AccrualWebhookSecret, timestamp, body, r.Header.Get(accrualSignatureHeader)) {
+		log.Printf("reject accrual webhook from %s: bad signature\n", clientIP(r))
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if !freshTimestamp(timestamp, time.Now()) {
+		log.Printf("reject accrual webhook from %s: stale timestamp %s\n", clientIP(r), timestamp)
+		http.Error(w, "stale signature", http.StatusUnauthorized)
+		return
+	}
+
+	var results []models.AccrualResponse
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &results)
+	} else {
+		var result models.AccrualResponse
+		err = json.Unmarshal(body, &result)
+		results = append(results, result)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, result := range results {
+		if result.Order == "" || result.Status == "" {
+			http.Error(w, "order and status are required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// у каждого запроса своя аренда, чтобы параллельные запросы не снимали аренды друг друга
+	suffix, err := randomHex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owner := ls.InstanceID + "-webhook-" + suffix[:8]
+
+	logicSystem := service.LogicSystem{Ctx: r.Context(), Storage: ls.Storage}
+	outcomes, err := logicSystem.AccrualWebhookLogic(results, owner, ls.AccrualLeaseTTL, ls.accrualBackoff())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(outcomes)
+}
+
+// validSignature сравнивает подпись за постоянное время
+func validSignature(secret string, timestamp string, body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(got) == 0 || timestamp == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// freshTimestamp подпись сделана не дальше accrualSignatureWindow от now
+func freshTimestamp(timestamp string, now time.Time) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	return skew <= accrualSignatureWindow && skew >= -accrualSignatureWindow
+}
@@ -2,20 +2,121 @@ package serverconfig
 
 import (
 	"flag"
+	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type ConfigStore struct {
-	FlagRunAddr  string
-	FlagDatabase string
-	FlagAccrual  string
+	FlagRunAddr   string
+	FlagDatabase  string
+	FlagAccrual   string
+	FlagSecretKey string
+	FlagDevMode   bool
+	FlagTokenTTL  time.Duration
+	FlagResetTTL  time.Duration
+	FlagMailFile  string
+	FlagMailFrom  string
+	FlagSMTPAddr  string
+	FlagSMTPUser  string
+	FlagSMTPPass  string
+
+	FlagLoginMaxFailures int
+	FlagIPMaxFailures    int
+	FlagLockoutDuration  time.Duration
+	FlagMaxLockout       time.Duration
+
+	FlagWithdrawTOTPThreshold float64
+
+	FlagAdminLogin    string
+	FlagAdminPassword string
+
+	FlagBcryptCost        int
+	FlagPasswordMinLength int
+	FlagPasswordDenyList  string
+
+	FlagEmailVerification bool
+	FlagVerificationTTL   time.Duration
+
+	FlagOIDCIssuer       string
+	FlagOIDCClientID     string
+	FlagOIDCClientSecret string
+	FlagOIDCRedirectURL  string
+
+	FlagCookieSecure   bool
+	FlagCookieSameSite string
+	FlagCSRF           bool
+
+	FlagAccrualWorkers    int
+	FlagAccrualRateLimit  float64
+	FlagAccrualBatchSize  int
+	FlagAccrualMaxBackoff time.Duration
+	FlagAccrualLeaseTTL   time.Duration
+
+	FlagAccrualTimeout            time.Duration
+	FlagAccrualRetries            int
+	FlagAccrualCAFile             string
+	FlagAccrualClientCert         string
+	FlagAccrualClientKey          string
+	FlagAccrualInsecureSkipVerify bool
+	FlagAccrualWebhookSecret      string
 }
 
 func NewConfigStore() *ConfigStore {
 	return &ConfigStore{
-		FlagRunAddr:  "",
-		FlagDatabase: "",
-		FlagAccrual:  "",
+		FlagRunAddr:   "",
+		FlagDatabase:  "",
+		FlagAccrual:   "",
+		FlagSecretKey: "",
+		FlagDevMode:   false,
+		FlagTokenTTL:  0,
+		FlagResetTTL:  0,
+		FlagMailFile:  "",
+		FlagMailFrom:  "",
+		FlagSMTPAddr:  "",
+		FlagSMTPUser:  "",
+		FlagSMTPPass:  "",
+
+		FlagLoginMaxFailures: 0,
+		FlagIPMaxFailures:    0,
+		FlagLockoutDuration:  0,
+		FlagMaxLockout:       0,
+
+		FlagWithdrawTOTPThreshold: 0,
+
+		FlagAdminLogin:    "",
+		FlagAdminPassword: "",
+
+		FlagBcryptCost:        0,
+		FlagPasswordMinLength: 0,
+		FlagPasswordDenyList:  "",
+
+		FlagEmailVerification: false,
+		FlagVerificationTTL:   0,
+
+		FlagOIDCIssuer:       "",
+		FlagOIDCClientID:     "",
+		FlagOIDCClientSecret: "",
+		FlagOIDCRedirectURL:  "",
+
+		FlagCookieSecure:   false,
+		FlagCookieSameSite: "",
+		FlagCSRF:           false,
+
+		FlagAccrualWorkers:    0,
+		FlagAccrualRateLimit:  0,
+		FlagAccrualBatchSize:  0,
+		FlagAccrualMaxBackoff: 0,
+		FlagAccrualLeaseTTL:   0,
+
+		FlagAccrualTimeout:            0,
+		FlagAccrualRetries:            0,
+		FlagAccrualCAFile:             "",
+		FlagAccrualClientCert:         "",
+		FlagAccrualClientKey:          "",
+		FlagAccrualInsecureSkipVerify: false,
+		FlagAccrualWebhookSecret:      "",
 	}
 }
 
@@ -27,6 +128,56 @@ func (configStore *ConfigStore) ParseFlags() {
 	flag.StringVar(&configStore.FlagRunAddr, "a", ":8080", "address and port to run server")
 	flag.StringVar(&configStore.FlagDatabase, "d", "", "data for connecting to db")
 	flag.StringVar(&configStore.FlagAccrual, "r", "", "accrual service url")
+	flag.StringVar(&configStore.FlagSecretKey, "k", "", "secret key for signing session tokens")
+	// в режиме разработки без ключа сервер запустится со случайным ключом, иначе откажется стартовать
+	flag.BoolVar(&configStore.FlagDevMode, "dev", false, "development mode: allow running without secret key")
+	flag.DurationVar(&configStore.FlagTokenTTL, "token-ttl", 24*time.Hour, "session token lifetime")
+	flag.DurationVar(&configStore.FlagResetTTL, "reset-ttl", time.Hour, "password reset token lifetime")
+	// без SMTP письма пишутся в файл, а без файла - в stdout
+	flag.StringVar(&configStore.FlagMailFile, "mail-file", "", "file to write outgoing emails to instead of sending them")
+	flag.StringVar(&configStore.FlagMailFrom, "mail-from", "gophermart@localhost", "sender address for outgoing emails")
+	flag.StringVar(&configStore.FlagSMTPAddr, "smtp-addr", "", "SMTP server host:port")
+	flag.StringVar(&configStore.FlagSMTPUser, "smtp-user", "", "SMTP username")
+	flag.StringVar(&configStore.FlagSMTPPass, "smtp-password", "", "SMTP password")
+	// защита от подбора пароля: после N неудач вход блокируется, блокировка удваивается с каждой новой неудачей
+	flag.IntVar(&configStore.FlagLoginMaxFailures, "login-max-failures", 5, "failed logins per account before lockout, 0 disables")
+	flag.IntVar(&configStore.FlagIPMaxFailures, "ip-max-failures", 20, "failed logins per IP before lockout, 0 disables")
+	flag.DurationVar(&configStore.FlagLockoutDuration, "lockout", time.Minute, "first lockout duration")
+	flag.DurationVar(&configStore.FlagMaxLockout, "max-lockout", time.Hour, "maximum lockout duration")
+	flag.Float64Var(&configStore.FlagWithdrawTOTPThreshold, "withdraw-totp-threshold", 0, "withdrawals above this sum require a two-factor code, 0 disables")
+	// первый администратор: существующий пользователь получит роль admin, иначе будет создан с этим паролем
+	flag.StringVar(&configStore.FlagAdminLogin, "admin-login", "", "login of the user to seed as admin")
+	flag.StringVar(&configStore.FlagAdminPassword, "admin-password", "", "password for the seeded admin if the user does not exist yet")
+	// политика паролей, стоимость bcrypt можно поднимать: старые хеши обновятся при входе
+	flag.IntVar(&configStore.FlagBcryptCost, "bcrypt-cost", 10, "bcrypt cost for password hashes")
+	flag.IntVar(&configStore.FlagPasswordMinLength, "password-min-length", 1, "minimum password length")
+	flag.StringVar(&configStore.FlagPasswordDenyList, "password-deny-list", "", "file with denied passwords, one per line")
+	// подтверждение почты при регистрации, по умолчанию выключено
+	flag.BoolVar(&configStore.FlagEmailVerification, "email-verification", false, "require email verification before withdrawals")
+	flag.DurationVar(&configStore.FlagVerificationTTL, "verification-ttl", 24*time.Hour, "email verification token lifetime")
+	// вход через SSO по OpenID Connect, без issuer выключен
+	flag.StringVar(&configStore.FlagOIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL")
+	flag.StringVar(&configStore.FlagOIDCClientID, "oidc-client-id", "", "OpenID Connect client id")
+	flag.StringVar(&configStore.FlagOIDCClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&configStore.FlagOIDCRedirectURL, "oidc-redirect-url", "", "callback URL registered at the provider, e.g. https://host/api/user/oidc/callback")
+	// атрибуты cookie и защита от CSRF для браузерных клиентов
+	flag.BoolVar(&configStore.FlagCookieSecure, "cookie-secure", false, "send cookies only over HTTPS")
+	flag.StringVar(&configStore.FlagCookieSameSite, "cookie-samesite", "lax", "SameSite attribute for cookies: lax, strict or none")
+	flag.BoolVar(&configStore.FlagCSRF, "csrf", false, "require X-CSRF-Token for state-changing cookie-authenticated requests")
+	// параллельная проверка заказов в accrual
+	flag.IntVar(&configStore.FlagAccrualWorkers, "accrual-workers", 4, "number of concurrent accrual requests")
+	flag.Float64Var(&configStore.FlagAccrualRateLimit, "accrual-rps", 0, "accrual requests per second shared by all workers, 0 - learn the limit from 429 responses")
+	flag.IntVar(&configStore.FlagAccrualBatchSize, "accrual-batch", 100, "max orders checked in accrual per polling cycle")
+	flag.DurationVar(&configStore.FlagAccrualMaxBackoff, "accrual-max-backoff", time.Hour, "max delay between rechecks of an order accrual has no result for")
+	flag.DurationVar(&configStore.FlagAccrualLeaseTTL, "accrual-lease-ttl", 5*time.Minute, "how long an instance owns the orders it polls, must exceed one polling cycle")
+	// HTTP клиент accrual
+	flag.DurationVar(&configStore.FlagAccrualTimeout, "accrual-timeout", 10*time.Second, "timeout of a single accrual request")
+	flag.IntVar(&configStore.FlagAccrualRetries, "accrual-retries", 2, "retries of an accrual request after a network error or 5xx")
+	flag.StringVar(&configStore.FlagAccrualCAFile, "accrual-ca-file", "", "PEM file with CA certificates to verify accrual https certificate")
+	flag.StringVar(&configStore.FlagAccrualClientCert, "accrual-client-cert", "", "PEM client certificate for mutual TLS with accrual")
+	flag.StringVar(&configStore.FlagAccrualClientKey, "accrual-client-key", "", "PEM private key of the accrual client certificate")
+	flag.BoolVar(&configStore.FlagAccrualInsecureSkipVerify, "accrual-insecure-skip-verify", false, "do not verify accrual https certificate, for debugging only")
+	flag.StringVar(&configStore.FlagAccrualWebhookSecret, "accrual-webhook-secret", "", "HMAC secret of results pushed by accrual to /api/accrual/webhook, empty - polling only")
 	// парсим переданные серверу аргументы в зарегистрированные переменные
 	flag.Parse()
 
@@ -41,4 +192,196 @@ func (configStore *ConfigStore) ParseFlags() {
 	if envLogLevel := os.Getenv("ACCRUAL_SYSTEM_ADDRESS"); envLogLevel != "" {
 		configStore.FlagAccrual = envLogLevel
 	}
+
+	if envSecretKey := os.Getenv("SECRET_KEY"); envSecretKey != "" {
+		configStore.FlagSecretKey = envSecretKey
+	}
+
+	if envDevMode := os.Getenv("DEV_MODE"); envDevMode != "" {
+		configStore.FlagDevMode = parseBoolEnv("DEV_MODE", envDevMode)
+	}
+
+	if envTokenTTL := os.Getenv("TOKEN_TTL"); envTokenTTL != "" {
+		configStore.FlagTokenTTL = parseDurationEnv("TOKEN_TTL", envTokenTTL)
+	}
+
+	if envResetTTL := os.Getenv("RESET_TOKEN_TTL"); envResetTTL != "" {
+		configStore.FlagResetTTL = parseDurationEnv("RESET_TOKEN_TTL", envResetTTL)
+	}
+
+	if envMailFile := os.Getenv("MAIL_FILE"); envMailFile != "" {
+		configStore.FlagMailFile = envMailFile
+	}
+
+	if envMailFrom := os.Getenv("MAIL_FROM"); envMailFrom != "" {
+		configStore.FlagMailFrom = envMailFrom
+	}
+
+	if envSMTPAddr := os.Getenv("SMTP_ADDRESS"); envSMTPAddr != "" {
+		configStore.FlagSMTPAddr = envSMTPAddr
+	}
+
+	if envSMTPUser := os.Getenv("SMTP_USER"); envSMTPUser != "" {
+		configStore.FlagSMTPUser = envSMTPUser
+	}
+
+	if envSMTPPass := os.Getenv("SMTP_PASSWORD"); envSMTPPass != "" {
+		configStore.FlagSMTPPass = envSMTPPass
+	}
+
+	if envLoginMaxFailures := os.Getenv("LOGIN_MAX_FAILURES"); envLoginMaxFailures != "" {
+		configStore.FlagLoginMaxFailures = parseIntEnv("LOGIN_MAX_FAILURES", envLoginMaxFailures)
+	}
+
+	if envIPMaxFailures := os.Getenv("IP_MAX_FAILURES"); envIPMaxFailures != "" {
+		configStore.FlagIPMaxFailures = parseIntEnv("IP_MAX_FAILURES", envIPMaxFailures)
+	}
+
+	if envLockout := os.Getenv("LOCKOUT_DURATION"); envLockout != "" {
+		configStore.FlagLockoutDuration = parseDurationEnv("LOCKOUT_DURATION", envLockout)
+	}
+
+	if envMaxLockout := os.Getenv("MAX_LOCKOUT_DURATION"); envMaxLockout != "" {
+		configStore.FlagMaxLockout = parseDurationEnv("MAX_LOCKOUT_DURATION", envMaxLockout)
+	}
+
+	if envWithdrawTOTPThreshold := os.Getenv("WITHDRAW_TOTP_THRESHOLD"); envWithdrawTOTPThreshold != "" {
+		threshold, err := strconv.ParseFloat(envWithdrawTOTPThreshold, 64)
+		if err != nil {
+			log.Fatalf("Invalid WITHDRAW_TOTP_THRESHOLD %q: %v", envWithdrawTOTPThreshold, err)
+		}
+		configStore.FlagWithdrawTOTPThreshold = threshold
+	}
+
+	if envAdminLogin := os.Getenv("ADMIN_LOGIN"); envAdminLogin != "" {
+		configStore.FlagAdminLogin = envAdminLogin
+	}
+
+	if envAdminPassword := os.Getenv("ADMIN_PASSWORD"); envAdminPassword != "" {
+		configStore.FlagAdminPassword = envAdminPassword
+	}
+
+	if envBcryptCost := os.Getenv("BCRYPT_COST"); envBcryptCost != "" {
+		configStore.FlagBcryptCost = parseIntEnv("BCRYPT_COST", envBcryptCost)
+	}
+
+	if envPasswordMinLength := os.Getenv("PASSWORD_MIN_LENGTH"); envPasswordMinLength != "" {
+		configStore.FlagPasswordMinLength = parseIntEnv("PASSWORD_MIN_LENGTH", envPasswordMinLength)
+	}
+
+	if envPasswordDenyList := os.Getenv("PASSWORD_DENY_LIST"); envPasswordDenyList != "" {
+		configStore.FlagPasswordDenyList = envPasswordDenyList
+	}
+
+	if envEmailVerification := os.Getenv("EMAIL_VERIFICATION"); envEmailVerification != "" {
+		configStore.FlagEmailVerification = parseBoolEnv("EMAIL_VERIFICATION", envEmailVerification)
+	}
+
+	if envVerificationTTL := os.Getenv("VERIFICATION_TOKEN_TTL"); envVerificationTTL != "" {
+		configStore.FlagVerificationTTL = parseDurationEnv("VERIFICATION_TOKEN_TTL", envVerificationTTL)
+	}
+
+	if envOIDCIssuer := os.Getenv("OIDC_ISSUER"); envOIDCIssuer != "" {
+		configStore.FlagOIDCIssuer = envOIDCIssuer
+	}
+
+	if envOIDCClientID := os.Getenv("OIDC_CLIENT_ID"); envOIDCClientID != "" {
+		configStore.FlagOIDCClientID = envOIDCClientID
+	}
+
+	if envOIDCClientSecret := os.Getenv("OIDC_CLIENT_SECRET"); envOIDCClientSecret != "" {
+		configStore.FlagOIDCClientSecret = envOIDCClientSecret
+	}
+
+	if envOIDCRedirectURL := os.Getenv("OIDC_REDIRECT_URL"); envOIDCRedirectURL != "" {
+		configStore.FlagOIDCRedirectURL = envOIDCRedirectURL
+	}
+
+	if envCookieSecure := os.Getenv("COOKIE_SECURE"); envCookieSecure != "" {
+		configStore.FlagCookieSecure = parseBoolEnv("COOKIE_SECURE", envCookieSecure)
+	}
+
+	if envCookieSameSite := os.Getenv("COOKIE_SAMESITE"); envCookieSameSite != "" {
+		configStore.FlagCookieSameSite = envCookieSameSite
+	}
+
+	if envCSRF := os.Getenv("CSRF_PROTECTION"); envCSRF != "" {
+		configStore.FlagCSRF = parseBoolEnv("CSRF_PROTECTION", envCSRF)
+	}
+
+	if envAccrualWorkers := os.Getenv("ACCRUAL_WORKERS"); envAccrualWorkers != "" {
+		configStore.FlagAccrualWorkers = parseIntEnv("ACCRUAL_WORKERS", envAccrualWorkers)
+	}
+
+	if envAccrualRateLimit := os.Getenv("ACCRUAL_RPS"); envAccrualRateLimit != "" {
+		rateLimit, err := strconv.ParseFloat(envAccrualRateLimit, 64)
+		if err != nil {
+			log.Fatalf("Invalid ACCRUAL_RPS %q: %v", envAccrualRateLimit, err)
+		}
+		configStore.FlagAccrualRateLimit = rateLimit
+	}
+
+	if envAccrualBatchSize := os.Getenv("ACCRUAL_BATCH"); envAccrualBatchSize != "" {
+		configStore.FlagAccrualBatchSize = parseIntEnv("ACCRUAL_BATCH", envAccrualBatchSize)
+	}
+
+	if envAccrualMaxBackoff := os.Getenv("ACCRUAL_MAX_BACKOFF"); envAccrualMaxBackoff != "" {
+		configStore.FlagAccrualMaxBackoff = parseDurationEnv("ACCRUAL_MAX_BACKOFF", envAccrualMaxBackoff)
+	}
+
+	if envAccrualLeaseTTL := os.Getenv("ACCRUAL_LEASE_TTL"); envAccrualLeaseTTL != "" {
+		configStore.FlagAccrualLeaseTTL = parseDurationEnv("ACCRUAL_LEASE_TTL", envAccrualLeaseTTL)
+	}
+
+	if envAccrualTimeout := os.Getenv("ACCRUAL_TIMEOUT"); envAccrualTimeout != "" {
+		configStore.FlagAccrualTimeout = parseDurationEnv("ACCRUAL_TIMEOUT", envAccrualTimeout)
+	}
+
+	if envAccrualRetries := os.Getenv("ACCRUAL_RETRIES"); envAccrualRetries != "" {
+		configStore.FlagAccrualRetries = parseIntEnv("ACCRUAL_RETRIES", envAccrualRetries)
+	}
+
+	if envAccrualCAFile := os.Getenv("ACCRUAL_CA_FILE"); envAccrualCAFile != "" {
+		configStore.FlagAccrualCAFile = envAccrualCAFile
+	}
+
+	if envAccrualClientCert := os.Getenv("ACCRUAL_CLIENT_CERT"); envAccrualClientCert != "" {
+		configStore.FlagAccrualClientCert = envAccrualClientCert
+	}
+
+	if envAccrualClientKey := os.Getenv("ACCRUAL_CLIENT_KEY"); envAccrualClientKey != "" {
+		configStore.FlagAccrualClientKey = envAccrualClientKey
+	}
+
+	if envAccrualInsecure := os.Getenv("ACCRUAL_INSECURE_SKIP_VERIFY"); envAccrualInsecure != "" {
+		configStore.FlagAccrualInsecureSkipVerify = parseBoolEnv("ACCRUAL_INSECURE_SKIP_VERIFY", envAccrualInsecure)
+	}
+
+	if envAccrualWebhookSecret := os.Getenv("ACCRUAL_WEBHOOK_SECRET"); envAccrualWebhookSecret != "" {
+		configStore.FlagAccrualWebhookSecret = envAccrualWebhookSecret
+	}
+}
+
+func parseDurationEnv(name string, value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return duration
+}
+
+func parseIntEnv(name string, value string) int {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return number
+}
+
+func parseBoolEnv(name string, value string) bool {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return enabled
 }
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/mailer"
+	"github.com/theheadmen/goDipl2/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const accountDeletionPurpose = "account_deletion"
+
+// ExportUserDataLogic собирает профиль, заказы, списания, сессии и журнал безопасности ls.User
+func (ls *LogicSystem) ExportUserDataLogic(currentSessionID uint) (models.UserExport, error) {
+	export := models.UserExport{
+		ExportedAt: time.Now(),
+		Profile: models.ProfileExport{
+			ID:            ls.User.ID,
+			Login:         ls.User.Email,
+			Role:          ls.User.Role,
+			Balance:       ls.User.Balance,
+			EmailVerified: !ls.User.EmailUnverified,
+			TOTPEnabled:   ls.User.TOTPEnabled,
+			SSOLinked:     ls.User.OIDCSubject != nil,
+			CreatedAt:     ls.User.CreatedAt,
+		},
+	}
+
+	var err error
+	export.Orders, err = ls.GetOrderLogic()
+	if err != nil {
+		return export, err
+	}
+	export.Withdrawals, err = ls.GetWithdrawalsLogic()
+	if err != nil {
+		return export, err
+	}
+	export.Sessions, err = ls.GetSessionsLogic(currentSessionID)
+	if err != nil {
+		return export, err
+	}
+
+	// журнал может быть длинным, забираем его целиком постранично
+	export.SecurityEvents = []models.SecurityEventResponse{}
+	for offset := 0; ; offset += MaxSecurityEventsLimit {
+		page, err := ls.GetSecurityEventsLogic(MaxSecurityEventsLimit, offset)
+		if err != nil {
+			return export, err
+		}
+		export.SecurityEvents = append(export.SecurityEvents, page...)
+		if len(page) < MaxSecurityEventsLimit {
+			break
+		}
+	}
+	log.Printf("For user %d, exported personal data\n", ls.User.ID)
+
+	return export, nil
+}
+
+// RequestAccountDeletionLogic отправляет на login ls.User одноразовый токен, которым можно подтвердить удаление
+// вместо пароля. Нужен пользователям, пришедшим через SSO: их пароль случайный и им неизвестен
+func (ls *LogicSystem) RequestAccountDeletionLogic(mail mailer.Mailer, ttl time.Duration) (int /*responce code*/, error) {
+	token, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = ls.Storage.AddOneTimeToken(ls.Ctx, &dbconnector.OneTimeToken{
+		UserID:    ls.User.ID,
+		Purpose:   accountDeletionPurpose,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	body := fmt.Sprintf("Someone requested deletion of your Gophermart account.\n\n"+
+		"Deletion token: %s\n\nThe token is valid for %s. If it was not you, change your password and ignore this email.", token, ttl)
+	err = mail.Send(ls.Ctx, ls.User.Email, "Gophermart account deletion", body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, sent account deletion token\n", ls.User.ID)
+
+	return http.StatusAccepted, nil
+}
+
+// DeleteAccountLogic после проверки пароля или токена из письма удаляет все данные входа, обезличивает пользователя
+// и удаляет его. Заказы и списания остаются в базе для учета, но больше не связаны с логином
+func (ls *LogicSystem) DeleteAccountLogic(deleteRequest models.DeleteAccountRequest) (int /*responce code*/, error) {
+	code, err := ls.checkAccountDeletion(deleteRequest)
+	if err != nil {
+		return code, err
+	}
+
+	login := ls.User.Email
+	ls.User.Email = fmt.Sprintf("deleted-%d@invalid", ls.User.ID)
+	ls.User.Password = ""
+	ls.User.TOTPSecret = ""
+	ls.User.TOTPEnabled = false
+	ls.User.OIDCSubject = nil
+
+	err = ls.Storage.PurgeUserData(ls.Ctx, ls.User, login, loginThrottleKey(login))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = ls.Storage.DeleteUser(ls.Ctx, ls.User)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("user %d deleted, personal data removed\n", ls.User.ID)
+
+	return http.StatusOK, nil
+}
+
+// checkAccountDeletion удаление подтверждается паролем или токеном, выпущенным для этого же пользователя
+func (ls *LogicSystem) checkAccountDeletion(deleteRequest models.DeleteAccountRequest) (int /*responce code*/, error) {
+	if deleteRequest.Token != "" {
+		token, err := ls.Storage.UseOneTimeToken(ls.Ctx, accountDeletionPurpose, hashToken(deleteRequest.Token))
+		if err == errors.ErrInvalidOneTimeToken || (err == nil && token.UserID != ls.User.ID) {
+			log.Printf("For user %d, invalid token on account deletion\n", ls.User.ID)
+			return http.StatusUnauthorized, errors.ErrInvalidOneTimeToken
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return 0, nil
+	}
+
+	if deleteRequest.Password == "" {
+		return http.StatusBadRequest, fmt.Errorf("password or token is required")
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(ls.User.Password), []byte(deleteRequest.Password))
+	if err != nil {
+		log.Printf("For user %d, wrong password on account deletion\n", ls.User.ID)
+		return http.StatusUnauthorized, fmt.Errorf("invalid password")
+	}
+	return 0, nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+)
+
+// AccrualResult ответ системы расчета начислений о заказе
+type AccrualResult struct {
+	// Status статус заказа в accrual как есть (REGISTERED, PROCESSING, INVALID, PROCESSED)
+	Status  string
+	Accrual float64
+	// NotRegistered заказ accrual не знает (204)
+	NotRegistered bool
+	// TooManyRequests сервис отказал из-за лимита (429). RetryAfter сколько он просил подождать,
+	// RequestsPerMinute лимит, если сервис его назвал, 0 - неизвестен
+	TooManyRequests   bool
+	RetryAfter        time.Duration
+	RequestsPerMinute int
+}
+
+// AccrualClient клиент системы расчета начислений. Ошибка - ответа о заказе нет вовсе
+// (сеть, 5xx, непонятный ответ), отказ по лимиту и неизвестный заказ - это результат, а не ошибка
+type AccrualClient interface {
+	GetOrder(ctx context.Context, number string) (AccrualResult, error)
+}
+
+// CheckOrderLogic спрашивает accrual о заказе, арендованном owner, и применяет ответ: новый статус,
+// начисление и время следующей проверки. Если результата пока нет, проверка откладывается по backoff,
+// отказ по лимиту попыткой не считается - его обрабатывает тот, кто опрашивает заказы
+func (ls *LogicSystem) CheckOrderLogic(client AccrualClient, ord *dbconnector.Order, owner string, backoff OrderBackoff) (AccrualResult, error) {
+	log.Printf("Try to fetch order: %s\n", ord.Number)
+	result, err := client.GetOrder(ls.Ctx, ord.Number)
+	if err != nil {
+		// запрос отменили мы сами, сервис тут ни при чем
+		if ls.Ctx.Err() == nil {
+			ls.scheduleNextCheck(ord, backoff)
+		}
+		return result, err
+	}
+	if result.TooManyRequests {
+		log.Println("Сервис попросил повторить запрос через", result.RetryAfter)
+		return result, fmt.Errorf("превышено количество запросов к сервису")
+	}
+	if result.NotRegistered {
+		ls.scheduleNextCheck(ord, backoff)
+		return result, fmt.Errorf("такого order нет для сервиса")
+	}
+	log.Printf("We get status %s and accrual %f\n", result.Status, result.Accrual)
+
+	return result, ls.applyAccrualResult(ord, result, owner, backoff)
+}
+
+// applyAccrualResult переводит заказ в новый статус по ответу accrual и сохраняет его вместе с начислением
+func (ls *LogicSystem) applyAccrualResult(ord *dbconnector.Order, result AccrualResult, owner string, backoff OrderBackoff) error {
+	// Статус accrual переводим в наш, недопустимый переход не применяем
+	next, err := NextOrderStatus(ord.Number, ord.Status, result.Status)
+	if err != nil {
+		// окончательный статус уже не поменяется, проверять такой заказ незачем
+		if current, parseErr := ParseOrderStatus(ord.Status); parseErr == nil && !current.IsFinal() {
+			ls.scheduleNextCheck(ord, backoff)
+		}
+		return fmt.Errorf("ответ accrual не применен: %w", err)
+	}
+
+	statusChanged := ord.Status != string(next)
+	ord.Status = string(next)
+	if next == OrderStatusProcessed {
+		// баллы бывают только у обработанного заказа
+		ord.Points = result.Accrual
+	}
+	if next.IsFinal() {
+		// заказ больше не проверяем
+		ord.NextCheckAt = nil
+	} else {
+		// расписание сохранится вместе с заказом
+		planNextCheck(ord, statusChanged, backoff)
+	}
+
+	// Обновляем запись в базе данных и начисляем баллы одной транзакцией, если заказ все еще за нами
+	leased, err := ls.Storage.ApplyAccrualResult(ls.Ctx, ord, owner)
+	if err != nil {
+		return fmt.Errorf("ошибка при обновлении записи в базе данных: %w", err)
+	}
+	if !leased {
+		// аренда истекла и заказ проверяет другая реплика, начислит тоже она
+		log.Printf("order %s is leased by other instance, skip result\n", ord.Number)
+		return nil
+	}
+	if ord.Credited {
+		log.Printf("User %d credited with %f for order %s\n", ord.UserID, ord.Points, ord.Number)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	stderrors "errors"
+	"log"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/models"
+	"gorm.io/gorm"
+)
+
+// итог применения присланного результата, см. models.AccrualWebhookResult
+const (
+	WebhookResultApplied  = "applied"
+	WebhookResultNotFound = "not_found"
+	WebhookResultBusy     = "busy"
+	WebhookResultRejected = "rejected"
+)
+
+// AccrualWebhookLogic применяет результаты расчета, которые accrual прислал сам, тем же путем, что и опрос:
+// заказ берется в аренду owner, статус проходит через машину состояний, баллы начисляются один раз.
+// Заказ, который сейчас проверяет опрос, пропускаем - опрос получит тот же результат.
+// Заказ в окончательном статусе, в том числе заказ на списание, не меняем: ни статус, ни баллы
+func (ls *LogicSystem) AccrualWebhookLogic(results []models.AccrualResponse, owner string, leaseFor time.Duration, backoff OrderBackoff) ([]models.AccrualWebhookResult, error) {
+	defer func() {
+		// аренды снимаем, даже если accrual уже закрыл соединение
+		if err := ls.Storage.ReleaseOrders(context.WithoutCancel(ls.Ctx), owner); err != nil {
+			log.Printf("can't release orders leased by %s: %v\n", owner, err)
+		}
+	}()
+
+	outcomes := make([]models.AccrualWebhookResult, len(results))
+	for i, result := range results {
+		outcomes[i].Order = result.Order
+
+		ord, claimed, err := ls.Storage.ClaimOrder(ls.Ctx, result.Order, owner, time.Now(), leaseFor)
+		if err == gorm.ErrRecordNotFound {
+			outcomes[i].Result = WebhookResultNotFound
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			outcomes[i].Result = WebhookResultBusy
+			continue
+		}
+		current, err := ParseOrderStatus(ord.Status)
+		if err != nil {
+			return nil, err
+		}
+		if current.IsFinal() {
+			outcomes[i].Result = WebhookResultRejected
+			continue
+		}
+
+		err = ls.applyAccrualResult(&ord, AccrualResult{Status: result.Status, Accrual: result.Accrual}, owner, backoff)
+		if stderrors.Is(err, errors.ErrIllegalOrderStatusTransition) || stderrors.Is(err, errors.ErrUnknownOrderStatus) {
+			outcomes[i].Result = WebhookResultRejected
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		outcomes[i].Result = WebhookResultApplied
+	}
+	return outcomes, nil
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/models"
+)
+
+// Права, которые можно выдать API ключу. Сессия пользователя может все
+const (
+	ScopeOrdersWrite = "orders:write"
+	ScopeOrdersRead  = "orders:read"
+	ScopeBalanceRead = "balance:read"
+	ScopeWithdraw    = "withdraw"
+)
+
+var knownScopes = map[string]bool{
+	ScopeOrdersWrite: true,
+	ScopeOrdersRead:  true,
+	ScopeBalanceRead: true,
+	ScopeWithdraw:    true,
+}
+
+const (
+	apiKeyPrefix = "gm_"
+	// сколько первых символов ключа показываем в списке, чтобы его можно было узнать
+	apiKeyVisiblePrefixLen = len(apiKeyPrefix) + 8
+	apiKeyTouchInterval    = time.Minute
+)
+
+// CreateAPIKeyLogic выпускает новый ключ для ls.User. Ключ целиком есть только в ответе, потом его не восстановить
+func (ls *LogicSystem) CreateAPIKeyLogic(keyRequest models.APIKeyRequest) (models.APIKeyResponse, error) {
+	if len(keyRequest.Scopes) == 0 {
+		return models.APIKeyResponse{}, errors.ErrInvalidScope
+	}
+	for _, scope := range keyRequest.Scopes {
+		if !knownScopes[scope] {
+			return models.APIKeyResponse{}, errors.ErrInvalidScope
+		}
+	}
+	if keyRequest.ExpiresAt != nil && !keyRequest.ExpiresAt.After(time.Now()) {
+		return models.APIKeyResponse{}, errors.ErrInvalidAPIKey
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return models.APIKeyResponse{}, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(raw)
+
+	apiKey := dbconnector.APIKey{
+		UserID:    ls.User.ID,
+		Name:      keyRequest.Name,
+		Prefix:    key[:apiKeyVisiblePrefixLen],
+		KeyHash:   hashToken(key),
+		Scopes:    strings.Join(keyRequest.Scopes, " "),
+		ExpiresAt: keyRequest.ExpiresAt,
+	}
+	err := ls.Storage.AddAPIKey(ls.Ctx, &apiKey)
+	if err != nil {
+		return models.APIKeyResponse{}, err
+	}
+	log.Printf("For user %d, created api key %d with scopes %s\n", ls.User.ID, apiKey.ID, apiKey.Scopes)
+
+	keyResponse := apiKeyResponse(apiKey)
+	keyResponse.Key = key
+	return keyResponse, nil
+}
+
+func (ls *LogicSystem) GetAPIKeysLogic() ([]models.APIKeyResponse, error) {
+	apiKeys, err := ls.Storage.GetAPIKeysByUserID(ls.Ctx, ls.User.ID)
+	if err != nil {
+		return []models.APIKeyResponse{}, err
+	}
+
+	keyResponses := make([]models.APIKeyResponse, len(apiKeys))
+	for i, apiKey := range apiKeys {
+		keyResponses[i] = apiKeyResponse(apiKey)
+	}
+	return keyResponses, nil
+}
+
+func (ls *LogicSystem) RevokeAPIKeyLogic(keyID uint) error {
+	err := ls.Storage.RevokeAPIKey(ls.Ctx, keyID, ls.User.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("For user %d, revoked api key %d\n", ls.User.ID, keyID)
+	return nil
+}
+
+// ValidateAPIKeyLogic находит ключ и проверяет, что он не отозван и не просрочен
+func (ls *LogicSystem) ValidateAPIKeyLogic(key string) (dbconnector.APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return dbconnector.APIKey{}, errors.ErrInvalidAPIKey
+	}
+
+	apiKey, err := ls.Storage.GetAPIKeyByHash(ls.Ctx, hashToken(key))
+	if err != nil {
+		return apiKey, errors.ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt)) {
+		return apiKey, errors.ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if err := ls.Storage.TouchAPIKey(ls.Ctx, apiKey.ID, now); err != nil {
+			log.Printf("can't touch api key %d: %v\n", apiKey.ID, err)
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	return apiKey, nil
+}
+
+// APIKeyHasScope проверяет, выдано ли ключу такое право
+func APIKeyHasScope(apiKey *dbconnector.APIKey, scope string) bool {
+	for _, keyScope := range strings.Fields(apiKey.Scopes) {
+		if keyScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func apiKeyResponse(apiKey dbconnector.APIKey) models.APIKeyResponse {
+	return models.APIKeyResponse{
+		ID:         apiKey.ID,
+		Name:       apiKey.Name,
+		Prefix:     apiKey.Prefix,
+		Scopes:     strings.Fields(apiKey.Scopes),
+		CreatedAt:  apiKey.CreatedAt,
+		ExpiresAt:  apiKey.ExpiresAt,
+		RevokedAt:  apiKey.RevokedAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	sessionContextKey
+	apiKeyContextKey
+)
+
+// ContextWithUser кладет аутентифицированного пользователя в контекст запроса
+func ContextWithUser(ctx context.Context, user *dbconnector.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext достает пользователя, которого положил auth middleware
+func UserFromContext(ctx context.Context) (*dbconnector.User, bool) {
+	user, ok := ctx.Value(userContextKey).(*dbconnector.User)
+	return user, ok
+}
+
+// ContextWithSession кладет сессию, через которую пришел запрос, в контекст
+func ContextWithSession(ctx context.Context, session *dbconnector.Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// SessionFromContext достает сессию, которую положил auth middleware
+func SessionFromContext(ctx context.Context) (*dbconnector.Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(*dbconnector.Session)
+	return session, ok
+}
+
+// ContextWithAPIKey кладет API ключ, которым аутентифицирован запрос, в контекст
+func ContextWithAPIKey(ctx context.Context, apiKey *dbconnector.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, apiKey)
+}
+
+// APIKeyFromContext достает API ключ, если запрос пришел не от сессии, а по ключу
+func APIKeyFromContext(ctx context.Context) (*dbconnector.APIKey, bool) {
+	apiKey, ok := ctx.Value(apiKeyContextKey).(*dbconnector.APIKey)
+	return apiKey, ok
+}
+
+// NewLogicSystem собирает LogicSystem для запроса, пользователя берем из контекста
+func NewLogicSystem(ctx context.Context, storage Storage) *LogicSystem {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		user = &dbconnector.User{}
+	}
+	return &LogicSystem{Ctx: ctx, Storage: storage, User: user}
+}
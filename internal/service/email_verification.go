@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/mailer"
+)
+
+const emailVerificationPurpose = "email_verification"
+
+// SendEmailVerificationLogic выпускает одноразовый токен подтверждения почты и отправляет его на login пользователя
+func (ls *LogicSystem) SendEmailVerificationLogic(mail mailer.Mailer, ttl time.Duration) (int /*responce code*/, error) {
+	if !ls.User.EmailUnverified {
+		return http.StatusConflict, errors.ErrEmailAlreadyVerified
+	}
+
+	token, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = ls.Storage.AddOneTimeToken(ls.Ctx, &dbconnector.OneTimeToken{
+		UserID:    ls.User.ID,
+		Purpose:   emailVerificationPurpose,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	body := fmt.Sprintf("Welcome to Gophermart! Please confirm your email address.\n\n"+
+		"Verification token: %s\n\nThe token is valid for %s. Until then you can upload orders, but not withdraw points.", token, ttl)
+	err = mail.Send(ls.Ctx, ls.User.Email, "Gophermart email verification", body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, sent email verification token\n", ls.User.ID)
+
+	return http.StatusAccepted, nil
+}
+
+// ConfirmEmailLogic по одноразовому токену отмечает почту пользователя подтвержденной
+func (ls *LogicSystem) ConfirmEmailLogic(token string) (int /*responce code*/, error) {
+	if token == "" {
+		return http.StatusBadRequest, fmt.Errorf("token is required")
+	}
+
+	oneTimeToken, err := ls.Storage.UseOneTimeToken(ls.Ctx, emailVerificationPurpose, hashToken(token))
+	if err == errors.ErrInvalidOneTimeToken {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, oneTimeToken.UserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	user.EmailUnverified = false
+
+	err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "EmailUnverified")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, email verified\n", user.ID)
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"log"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+// LockoutPolicy пороги защиты от подбора пароля.
+// После MaxLoginFailures неудач на логин (или MaxIPFailures с одного IP) вход блокируется на LockoutDuration,
+// каждая следующая неудача удваивает блокировку, но не больше MaxLockout.
+// Неудачи старше MaxLockout забываются
+type LockoutPolicy struct {
+	MaxLoginFailures int
+	MaxIPFailures    int
+	LockoutDuration  time.Duration
+	MaxLockout       time.Duration
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxLoginFailures: 5,
+		MaxIPFailures:    20,
+		LockoutDuration:  time.Minute,
+		MaxLockout:       time.Hour,
+	}
+}
+
+// lockoutFor сколько еще действует блокировка для счетчика с таким порогом, 0 - не заблокирован
+func (p LockoutPolicy) lockoutFor(throttle dbconnector.LoginThrottle, maxFailures int, now time.Time) time.Duration {
+	if maxFailures <= 0 || throttle.Failures < maxFailures {
+		return 0
+	}
+
+	lockout := p.LockoutDuration
+	for i := maxFailures; i < throttle.Failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.MaxLockout {
+		lockout = p.MaxLockout
+	}
+
+	remaining := throttle.LastFailureAt.Add(lockout).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func loginThrottleKey(login string) string {
+	return "login:" + login
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLockout возвращает LockedOutError, если логин или IP сейчас заблокированы
+func (ls *LogicSystem) checkLockout(policy LockoutPolicy, clientIP string) error {
+	keys := []string{loginThrottleKey(ls.User.Email)}
+	if clientIP != "" {
+		keys = append(keys, ipThrottleKey(clientIP))
+	}
+
+	throttles, err := ls.Storage.GetLoginThrottles(ls.Ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, throttle := range throttles {
+		maxFailures := policy.MaxLoginFailures
+		if throttle.Key != loginThrottleKey(ls.User.Email) {
+			maxFailures = policy.MaxIPFailures
+		}
+		if lockout := policy.lockoutFor(throttle, maxFailures, now); lockout > retryAfter {
+			retryAfter = lockout
+		}
+	}
+
+	if retryAfter > 0 {
+		log.Printf("login for %s from %s is locked for %s\n", ls.User.Email, clientIP, retryAfter)
+		return &errors.LockedOutError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// registerLoginFailure засчитывает неудачную попытку и логину, и IP
+func (ls *LogicSystem) registerLoginFailure(policy LockoutPolicy, clientIP string) {
+	now := time.Now()
+	resetBefore := now.Add(-policy.MaxLockout)
+
+	keys := []string{loginThrottleKey(ls.User.Email)}
+	if clientIP != "" {
+		keys = append(keys, ipThrottleKey(clientIP))
+	}
+	for _, key := range keys {
+		// не смогли записать неудачу - отвечаем как обычно, просто без учета
+		if _, err := ls.Storage.AddLoginFailure(ls.Ctx, key, now, resetBefore); err != nil {
+			log.Printf("can't register login failure for %s: %v\n", key, err)
+		}
+	}
+}
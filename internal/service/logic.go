@@ -39,12 +39,36 @@ func IsValidLuhn(number string) bool {
 	return sum%10 == 0
 }
 
-func (ls *LogicSystem) WithdrawLogic(withdrawRequest models.WithdrawRequest) (int /*httpCode*/, error) {
+// WithdrawLogic списывает баллы. Если у пользователя включен второй фактор,
+// списание больше totpThreshold требует свежий код (0 - не требует никогда)
+func (ls *LogicSystem) WithdrawLogic(withdrawRequest models.WithdrawRequest, totpThreshold float64) (int /*httpCode*/, error) {
+	// баллы можно тратить только с подтвержденной почтой
+	if ls.User.EmailUnverified {
+		log.Printf("For user %d, withdraw is blocked until email is verified\n", ls.User.ID)
+		return http.StatusForbidden, errors.ErrEmailNotVerified
+	}
+
+	if ls.User.TOTPEnabled && totpThreshold > 0 && withdrawRequest.Sum > totpThreshold {
+		if withdrawRequest.TOTPCode == "" {
+			log.Printf("For user %d, withdraw of %f needs two-factor code\n", ls.User.ID, withdrawRequest.Sum)
+			return http.StatusForbidden, errors.ErrTOTPRequired
+		}
+		// для списания принимаем только код из приложения, резервные коды только для входа
+		if err := ls.checkTOTPCode(withdrawRequest.TOTPCode); err != nil {
+			if err == errors.ErrInvalidTOTPCode {
+				return http.StatusForbidden, err
+			}
+			return http.StatusInternalServerError, err
+		}
+	}
+
 	// Создаем новый заказ на списание
 	order := dbconnector.Order{
 		Number: withdrawRequest.Order,
 		UserID: ls.User.ID,
-		Status: "PROCESSED", // Предполагаем, что списание сразу обрабатывается
+		Status: string(OrderStatusProcessed), // Предполагаем, что списание сразу обрабатывается
+		// за заказ на списание баллы не начисляются
+		Credited: true,
 	}
 	// Создаем списание
 	withdrawal := dbconnector.Withdrawal{
@@ -122,9 +146,14 @@ func (ls *LogicSystem) GetOrderLogic() ([]models.OrderResponse, error) {
 	// Конвертируем список заказов в список ответов
 	orderResponses := make([]models.OrderResponse, len(orders))
 	for i, order := range orders {
+		// старые заказы могли сохраниться со статусом accrual, пользователю отдаем только статусы из спецификации
+		status := order.Status
+		if parsed, err := ParseOrderStatus(order.Status); err == nil {
+			status = string(parsed)
+		}
 		orderResponses[i] = models.OrderResponse{
 			Number:     order.Number,
-			Status:     order.Status,
+			Status:     status,
 			UploadedAt: order.CreatedAt,
 			Accrual:    order.Points,
 		}
@@ -170,17 +199,32 @@ func (ls *LogicSystem) LoadOrderLogic(orderNumber string) error {
 	return err
 }
 
-func (ls *LogicSystem) LoginUserLogic() (int /*responce code*/, error) {
+// LoginUserLogic проверяет логин и пароль, перебор пароля ограничен политикой lockout по логину и clientIP.
+// Если пароль захеширован не с той стоимостью, что в policy, перехешируем его, пока знаем пароль
+func (ls *LogicSystem) LoginUserLogic(lockout LockoutPolicy, policy PasswordPolicy, clientIP string, userAgent string) (int /*responce code*/, error) {
 	// Проверяем, что логин и пароль не пустые
 	if ls.User.Email == "" || ls.User.Password == "" {
 		log.Println("Login and password are required")
 		return http.StatusBadRequest, fmt.Errorf("login and password are required")
 	}
 
-	// Ищем пользователя в базе данных
-	checkedUser, err := ls.Storage.GetUserByEmail(ls.Ctx, ls.User.Email)
+	// Пока идет блокировка, даже не сверяем пароль
+	// Ищем пользователя в базе данных, ID нужен для журнала даже при неудаче
+	checkedUser, userErr := ls.Storage.GetUserByEmail(ls.Ctx, ls.User.Email)
+
+	err := ls.checkLockout(lockout, clientIP)
 	if err != nil {
+		if _, ok := err.(*errors.LockedOutError); ok {
+			ls.recordLoginAttempt(checkedUser.ID, false, "locked out", clientIP, userAgent)
+			return http.StatusTooManyRequests, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	if userErr != nil {
 		log.Println("Invalid login or password")
+		ls.registerLoginFailure(lockout, clientIP)
+		ls.recordLoginAttempt(0, false, "unknown login", clientIP, userAgent)
 		return http.StatusUnauthorized, fmt.Errorf("invalid login or password")
 	}
 
@@ -188,24 +232,60 @@ func (ls *LogicSystem) LoginUserLogic() (int /*responce code*/, error) {
 	err = bcrypt.CompareHashAndPassword([]byte(checkedUser.Password), []byte(ls.User.Password))
 	if err != nil {
 		log.Println("Invalid login or password")
+		ls.registerLoginFailure(lockout, clientIP)
+		ls.recordLoginAttempt(checkedUser.ID, false, "invalid password", clientIP, userAgent)
 		return http.StatusUnauthorized, fmt.Errorf("invalid login or password")
 	}
 
+	// успешный вход обнуляет счетчик по логину, счетчик по IP живет своей жизнью
+	err = ls.Storage.ResetLoginFailures(ls.Ctx, loginThrottleKey(checkedUser.Email))
+	if err != nil {
+		log.Printf("can't reset login failures for %s: %v\n", checkedUser.Email, err)
+	}
+
+	if policy.needsRehash(checkedUser.Password) {
+		// ошибка перехеширования не должна мешать входу, попробуем в следующий раз
+		hashedPassword, err := policy.hashPassword(ls.User.Password)
+		if err == nil {
+			checkedUser.Password = hashedPassword
+			err = ls.Storage.UpdateUserFields(ls.Ctx, &checkedUser, "Password")
+		}
+		if err != nil {
+			log.Printf("can't rehash password for user %d: %v\n", checkedUser.ID, err)
+		} else {
+			log.Printf("password for user %d rehashed with cost %d\n", checkedUser.ID, policy.cost())
+		}
+	}
+
+	detail := "password"
+	if checkedUser.TOTPEnabled {
+		detail = "password, two-factor code required"
+	}
+	ls.recordLoginAttempt(checkedUser.ID, true, detail, clientIP, userAgent)
+
+	// дальше работаем с пользователем из базы, нам нужен его ID для токена
+	ls.User = &checkedUser
+
 	return 0, nil
 }
 
-func (ls *LogicSystem) RegisterUserLogic() (int /*responce code*/, error) {
+func (ls *LogicSystem) RegisterUserLogic(policy PasswordPolicy) (int /*responce code*/, error) {
 	// Проверяем, что логин и пароль не пустые
 	if ls.User.Email == "" || ls.User.Password == "" {
 		return http.StatusBadRequest, fmt.Errorf("login and password are required")
 	}
 
+	err := policy.Check(ls.User.Email, ls.User.Password)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
 	// Хешируем пароль
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(ls.User.Password), bcrypt.DefaultCost)
+	hashedPassword, err := policy.hashPassword(ls.User.Password)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	ls.User.Password = string(hashedPassword)
+	ls.User.Password = hashedPassword
 
 	// Сохраняем пользователя в базе данных
 	err = ls.Storage.AddUser(ls.Ctx, ls.User)
@@ -215,3 +295,43 @@ func (ls *LogicSystem) RegisterUserLogic() (int /*responce code*/, error) {
 
 	return 0, nil
 }
+
+// ChangePasswordLogic меняет пароль ls.User и отзывает все его сессии, кроме текущей
+func (ls *LogicSystem) ChangePasswordLogic(changeRequest models.ChangePasswordRequest, currentSessionID uint, policy PasswordPolicy) (int /*responce code*/, error) {
+	if changeRequest.CurrentPassword == "" || changeRequest.NewPassword == "" {
+		return http.StatusBadRequest, fmt.Errorf("current and new passwords are required")
+	}
+
+	// Проверяем текущий пароль
+	err := bcrypt.CompareHashAndPassword([]byte(ls.User.Password), []byte(changeRequest.CurrentPassword))
+	if err != nil {
+		log.Printf("For user %d, wrong current password\n", ls.User.ID)
+		return http.StatusUnauthorized, fmt.Errorf("invalid current password")
+	}
+
+	err = policy.Check(ls.User.Email, changeRequest.NewPassword)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	hashedPassword, err := policy.hashPassword(changeRequest.NewPassword)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	ls.User.Password = hashedPassword
+
+	// ls.User загружен в начале запроса, поэтому сохраняем только пароль
+	err = ls.Storage.UpdateUserFields(ls.Ctx, ls.User, "Password")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// пароль могли украсть, поэтому все остальные устройства должны войти заново
+	err = ls.Storage.RevokeUserSessions(ls.Ctx, ls.User.ID, currentSessionID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, password changed, other sessions revoked\n", ls.User.ID)
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/oidc"
+	"gorm.io/gorm"
+)
+
+// OIDCLoginLogic находит пользователя по subject от провайдера, привязывает существующего по подтвержденной почте
+// или заводит нового. Найденный пользователь кладется в ls.User, дальше выдаем обычную сессию.
+// При emailVerification новый пользователь с неподтвержденной у провайдера почтой не сможет списывать баллы
+func (ls *LogicSystem) OIDCLoginLogic(identity oidc.Identity, policy PasswordPolicy, emailVerification bool, clientIP string, userAgent string) (int /*responce code*/, error) {
+	user, err := ls.Storage.GetUserByOIDCSubject(ls.Ctx, identity.Subject)
+	if err == nil {
+		ls.User = &user
+		ls.recordLoginAttempt(user.ID, true, "sso", clientIP, userAgent)
+		return 0, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return http.StatusInternalServerError, err
+	}
+
+	// привязываем только по почте, которую провайдер подтвердил, иначе можно захватить чужой аккаунт
+	if identity.Email != "" && identity.EmailVerified {
+		user, err = ls.Storage.GetUserByEmail(ls.Ctx, identity.Email)
+		if err == nil {
+			if user.OIDCSubject != nil {
+				log.Printf("user %d is already linked to other oidc subject\n", user.ID)
+				return http.StatusConflict, errors.ErrOIDCAlreadyLinked
+			}
+			user.OIDCSubject = &identity.Subject
+			err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "OIDCSubject")
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			log.Printf("user %d linked to oidc subject\n", user.ID)
+			ls.User = &user
+			ls.recordLoginAttempt(user.ID, true, "sso, linked by email", clientIP, userAgent)
+			return 0, nil
+		}
+		if err != gorm.ErrRecordNotFound {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	// пароля у такого пользователя нет, но поле обязательное - кладем хеш случайного пароля,
+	// войти по паролю он сможет после сброса
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	hashedPassword, err := policy.hashPassword(hex.EncodeToString(raw))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	email := identity.Email
+	if email == "" {
+		email = "oidc:" + identity.Subject
+	}
+	user = dbconnector.User{
+		Email:           email,
+		Password:        hashedPassword,
+		OIDCSubject:     &identity.Subject,
+		EmailUnverified: emailVerification && !identity.EmailVerified,
+	}
+	err = ls.Storage.AddUser(ls.Ctx, &user)
+	if err == errors.ErrLoginTaken {
+		// почта занята, а провайдер ее не подтвердил - привязывать нельзя
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("created user %d from oidc login\n", user.ID)
+	ls.User = &user
+	ls.recordLoginAttempt(user.ID, true, "sso, new account", clientIP, userAgent)
+	return 0, nil
+}
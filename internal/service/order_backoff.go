@@ -0,0 +1,50 @@
+package service
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+)
+
+// OrderBackoff расписание повторных проверок заказа в accrual: задержка удваивается с каждой попыткой
+// от Base до Max, и случайно сдвигается вниз до половины, чтобы заказы не ходили в сервис пачками
+type OrderBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay задержка перед попыткой номер attempts (с единицы), с джиттером
+func (b OrderBackoff) Delay(attempts int) time.Duration {
+	delay := b.Base
+	for i := 1; i < attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	// равномерно в [delay/2, delay]
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// planNextCheck назначает заказу время следующей проверки. Если статус сдвинулся, сервис работает с заказом
+// и счетчик попыток начинается заново, иначе задержка растет
+func planNextCheck(ord *dbconnector.Order, statusChanged bool, backoff OrderBackoff) {
+	if statusChanged {
+		ord.Attempts = 0
+	}
+	ord.Attempts++
+	nextCheckAt := time.Now().Add(backoff.Delay(ord.Attempts))
+	ord.NextCheckAt = &nextCheckAt
+}
+
+// scheduleNextCheck откладывает следующую проверку заказа, на который accrual не дал ответа
+func (ls *LogicSystem) scheduleNextCheck(ord *dbconnector.Order, backoff OrderBackoff) {
+	planNextCheck(ord, false, backoff)
+	err := ls.Storage.ScheduleOrderCheck(ls.Ctx, ord)
+	if err != nil {
+		log.Printf("can't schedule next check for order %s: %v\n", ord.Number, err)
+	}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+// OrderStatus статус заказа так, как его видит пользователь (см. SPECIFICATION.md)
+type OrderStatus string
+
+const (
+	// OrderStatusNew заказ загружен, но еще не попал в обработку
+	OrderStatusNew OrderStatus = "NEW"
+	// OrderStatusProcessing вознаграждение за заказ рассчитывается
+	OrderStatusProcessing OrderStatus = "PROCESSING"
+	// OrderStatusInvalid в расчете отказали, окончательный статус
+	OrderStatusInvalid OrderStatus = "INVALID"
+	// OrderStatusProcessed расчет закончен, окончательный статус
+	OrderStatusProcessed OrderStatus = "PROCESSED"
+)
+
+// статусы, которые отдает accrual
+const (
+	accrualStatusRegistered = "REGISTERED"
+	accrualStatusProcessing = "PROCESSING"
+	accrualStatusInvalid    = "INVALID"
+	accrualStatusProcessed  = "PROCESSED"
+)
+
+// orderTransitions куда можно перейти из каждого статуса, окончательные статусы не меняются
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusNew:        {OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+	OrderStatusProcessing: {OrderStatusInvalid, OrderStatusProcessed},
+}
+
+// ParseOrderStatus статус из базы. Раньше статус accrual сохранялся как есть, поэтому REGISTERED считаем PROCESSING
+func ParseOrderStatus(status string) (OrderStatus, error) {
+	switch OrderStatus(status) {
+	case OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed:
+		return OrderStatus(status), nil
+	}
+	if status == accrualStatusRegistered {
+		return OrderStatusProcessing, nil
+	}
+	return "", fmt.Errorf("%w: %q", errors.ErrUnknownOrderStatus, status)
+}
+
+// OrderStatusFromAccrual переводит статус accrual в наш: заказ, который accrual только зарегистрировал,
+// для пользователя уже в обработке
+func OrderStatusFromAccrual(accrualStatus string) (OrderStatus, error) {
+	switch accrualStatus {
+	case accrualStatusRegistered, accrualStatusProcessing:
+		return OrderStatusProcessing, nil
+	case accrualStatusInvalid:
+		return OrderStatusInvalid, nil
+	case accrualStatusProcessed:
+		return OrderStatusProcessed, nil
+	}
+	return "", fmt.Errorf("%w: accrual status %q", errors.ErrUnknownOrderStatus, accrualStatus)
+}
+
+// IsFinal статус больше не поменяется, заказ не нужно проверять в accrual
+func (s OrderStatus) IsFinal() bool {
+	return s == OrderStatusInvalid || s == OrderStatusProcessed
+}
+
+// CanTransitionTo можно ли перейти из s в next, остаться в том же статусе можно всегда
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOrderStatus статус заказа number после ответа accrual. Недопустимый переход
+// (например PROCESSED обратно в PROCESSING) не применяем и пишем в лог
+func NextOrderStatus(number string, current string, accrualStatus string) (OrderStatus, error) {
+	from, err := ParseOrderStatus(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := OrderStatusFromAccrual(accrualStatus)
+	if err != nil {
+		return "", err
+	}
+	if !from.CanTransitionTo(next) {
+		log.Printf("order %s: illegal status transition %s -> %s (accrual status %s)\n", number, from, next, accrualStatus)
+		return from, fmt.Errorf("%w: %s -> %s", errors.ErrIllegalOrderStatusTransition, from, next)
+	}
+	return next, nil
+}
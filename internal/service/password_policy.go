@@ -0,0 +1,91 @@
+package service
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy требования к новым паролям и стоимость bcrypt для их хеширования.
+// Cost можно поднимать на живой базе: старые хеши перехешируются при следующем успешном входе
+type PasswordPolicy struct {
+	Cost      int
+	MinLength int
+	// запрещенные пароли в нижнем регистре
+	DenyList map[string]bool
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		Cost:      bcrypt.DefaultCost,
+		MinLength: 1,
+		DenyList:  map[string]bool{},
+	}
+}
+
+// LoadPasswordDenyList читает файл со списком запрещенных паролей, по одному на строку, # - комментарий
+func LoadPasswordDenyList(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denyList := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denyList[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("loaded %d denied passwords from %s\n", len(denyList), path)
+	return denyList, nil
+}
+
+// Check проверяет пароль по политике, при пустом login совпадение с логином не проверяется
+func (p PasswordPolicy) Check(login string, password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return errors.ErrPasswordTooShort
+	}
+	if login != "" && strings.EqualFold(login, password) {
+		return errors.ErrPasswordEqualsLogin
+	}
+	if p.DenyList[strings.ToLower(password)] {
+		return errors.ErrPasswordDenied
+	}
+	return nil
+}
+
+func (p PasswordPolicy) hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), p.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+// needsRehash хеш сделан с другой стоимостью, чем сейчас в конфиге
+func (p PasswordPolicy) needsRehash(hashedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	if err != nil {
+		return false
+	}
+	return cost != p.cost()
+}
+
+func (p PasswordPolicy) cost() int {
+	if p.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return p.Cost
+}
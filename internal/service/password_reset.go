@@ -0,0 +1,129 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/mailer"
+	"github.com/theheadmen/goDipl2/internal/models"
+)
+
+const passwordResetPurpose = "password_reset"
+
+// RequestPasswordResetLogic выпускает одноразовый токен сброса пароля и отправляет его на login пользователя.
+// Если такого пользователя нет, молча ничего не делаем, чтобы по ответу нельзя было перебирать логины
+func (ls *LogicSystem) RequestPasswordResetLogic(resetRequest models.PasswordResetRequest, mail mailer.Mailer, ttl time.Duration) (int /*responce code*/, error) {
+	if resetRequest.Login == "" {
+		return http.StatusBadRequest, fmt.Errorf("login is required")
+	}
+
+	user, err := ls.Storage.GetUserByEmail(ls.Ctx, resetRequest.Login)
+	if err != nil {
+		log.Printf("password reset requested for unknown login %s\n", resetRequest.Login)
+		return http.StatusAccepted, nil
+	}
+
+	token, tokenHash, err := newOneTimeToken()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = ls.Storage.AddOneTimeToken(ls.Ctx, &dbconnector.OneTimeToken{
+		UserID:    user.ID,
+		Purpose:   passwordResetPurpose,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	body := fmt.Sprintf("Someone requested a password reset for your Gophermart account.\n\n"+
+		"Reset token: %s\n\nThe token is valid for %s. If it was not you, just ignore this email.", token, ttl)
+	err = mail.Send(ls.Ctx, user.Email, "Gophermart password reset", body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, sent password reset token\n", user.ID)
+
+	return http.StatusAccepted, nil
+}
+
+// ConfirmPasswordResetLogic по одноразовому токену ставит новый пароль и отзывает все сессии пользователя
+func (ls *LogicSystem) ConfirmPasswordResetLogic(confirmRequest models.PasswordResetConfirmRequest, policy PasswordPolicy) (int /*responce code*/, error) {
+	if confirmRequest.Token == "" || confirmRequest.Password == "" {
+		return http.StatusBadRequest, fmt.Errorf("token and password are required")
+	}
+
+	// токен одноразовый, поэтому сначала только находим его и проверяем пароль,
+	// а используем токен, когда все проверки пройдены: неподходящий пароль не сжигает ссылку из письма
+	token, err := ls.Storage.GetOneTimeToken(ls.Ctx, passwordResetPurpose, hashToken(confirmRequest.Token))
+	if err == errors.ErrInvalidOneTimeToken {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, token.UserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = policy.Check(user.Email, confirmRequest.Password)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	hashedPassword, err := policy.hashPassword(confirmRequest.Password)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	user.Password = hashedPassword
+
+	// токен могли использовать параллельно, пока считался хеш - тогда пароль не меняем
+	_, err = ls.Storage.UseOneTimeToken(ls.Ctx, passwordResetPurpose, hashToken(confirmRequest.Token))
+	if err == errors.ErrInvalidOneTimeToken {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// user прочитан до долгого хеширования, поэтому сохраняем только пароль
+	err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "Password")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// старый пароль мог утечь, поэтому выкидываем все устройства
+	err = ls.Storage.RevokeUserSessions(ls.Ctx, user.ID, 0)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("For user %d, password reset, all sessions revoked\n", user.ID)
+
+	return http.StatusOK, nil
+}
+
+// newOneTimeToken возвращает случайный токен для пользователя и его хеш для базы
+func newOneTimeToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
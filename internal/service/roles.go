@@ -0,0 +1,89 @@
+package service
+
+import (
+	"log"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+// Роли пользователей, по умолчанию у всех RoleUser
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Права на админские ручки, ручки проверяют право, а не роль
+const (
+	PermissionManageUsers    = "users:manage"
+	PermissionManageSessions = "sessions:manage"
+	PermissionManageAPIKeys  = "apikeys:manage"
+)
+
+var rolePermissions = map[string]map[string]bool{
+	RoleUser: {},
+	RoleAdmin: {
+		PermissionManageUsers:    true,
+		PermissionManageSessions: true,
+		PermissionManageAPIKeys:  true,
+	},
+}
+
+// HasPermission проверяет, дает ли роль пользователя это право
+func HasPermission(user *dbconnector.User, permission string) bool {
+	return rolePermissions[user.Role][permission]
+}
+
+// SetUserRoleLogic меняет роль пользователя userID
+func (ls *LogicSystem) SetUserRoleLogic(userID uint, role string) error {
+	if _, ok := rolePermissions[role]; !ok {
+		return errors.ErrInvalidRole
+	}
+
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, userID)
+	if err != nil {
+		return errors.ErrUserNotFound
+	}
+	user.Role = role
+
+	// пользователь мог параллельно сменить пароль или второй фактор, поэтому сохраняем только роль
+	err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "Role")
+	if err != nil {
+		return err
+	}
+	log.Printf("user %d set role %s for user %d\n", ls.User.ID, role, userID)
+	return nil
+}
+
+// SeedAdminLogic заводит первого администратора: существующего пользователя повышает (пароль не трогаем),
+// а если такого нет - создает с этим паролем
+func (ls *LogicSystem) SeedAdminLogic(login string, password string, policy PasswordPolicy) error {
+	user, err := ls.Storage.GetUserByEmail(ls.Ctx, login)
+	if err == nil {
+		if user.Role == RoleAdmin {
+			return nil
+		}
+		user.Role = RoleAdmin
+		log.Printf("promote user %d to admin\n", user.ID)
+		return ls.Storage.UpdateUserFields(ls.Ctx, &user, "Role")
+	}
+
+	if password == "" {
+		return errors.ErrUserNotFound
+	}
+	err = policy.Check(login, password)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := policy.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user = dbconnector.User{Email: login, Password: hashedPassword, Role: RoleAdmin}
+	err = ls.Storage.AddUser(ls.Ctx, &user)
+	if err != nil {
+		return err
+	}
+	log.Printf("created admin user %d\n", user.ID)
+	return nil
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"log"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/models"
+)
+
+// Типы событий журнала безопасности
+const (
+	SecurityEventLogin          = "login"
+	SecurityEventSessionCreated = "session_created"
+)
+
+// Размер страницы журнала, если клиент не попросил другой, и максимальный размер
+const (
+	DefaultSecurityEventsLimit = 20
+	MaxSecurityEventsLimit     = 100
+)
+
+// recordSecurityEvent пишет событие в журнал, ошибка записи не должна ломать вход
+func (ls *LogicSystem) recordSecurityEvent(event dbconnector.SecurityEvent) {
+	err := ls.Storage.AddSecurityEvent(ls.Ctx, &event)
+	if err != nil {
+		log.Printf("can't record security event %s for user %d: %v\n", event.Type, event.UserID, err)
+	}
+}
+
+// recordLoginAttempt пишет попытку входа под логином ls.User, userID = 0 если такого пользователя нет
+func (ls *LogicSystem) recordLoginAttempt(userID uint, success bool, detail string, clientIP string, userAgent string) {
+	ls.recordSecurityEvent(dbconnector.SecurityEvent{
+		UserID:    userID,
+		Login:     ls.User.Email,
+		Type:      SecurityEventLogin,
+		Success:   success,
+		Detail:    detail,
+		IP:        clientIP,
+		UserAgent: userAgent,
+	})
+}
+
+// GetSecurityEventsLogic страница журнала безопасности ls.User, новые события первыми
+func (ls *LogicSystem) GetSecurityEventsLogic(limit int, offset int) ([]models.SecurityEventResponse, error) {
+	if limit <= 0 {
+		limit = DefaultSecurityEventsLimit
+	}
+	if limit > MaxSecurityEventsLimit {
+		limit = MaxSecurityEventsLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	events, err := ls.Storage.GetSecurityEventsByUserID(ls.Ctx, ls.User.ID, limit, offset)
+	if err != nil {
+		return []models.SecurityEventResponse{}, err
+	}
+
+	eventResponses := make([]models.SecurityEventResponse, len(events))
+	for i, event := range events {
+		eventResponses[i] = models.SecurityEventResponse{
+			Type:      event.Type,
+			Success:   event.Success,
+			Detail:    event.Detail,
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			CreatedAt: event.CreatedAt,
+		}
+	}
+
+	return eventResponses, nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/dbconnector"
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/models"
+)
+
+// sessionTouchInterval как часто обновляем last_seen_at, чтобы не писать в базу на каждый запрос
+const sessionTouchInterval = time.Minute
+
+// CreateSessionLogic заводит новую сессию для ls.User, токен выпускается уже под нее
+func (ls *LogicSystem) CreateSessionLogic(device string, ip string, ttl time.Duration) (dbconnector.Session, error) {
+	now := time.Now()
+	session := dbconnector.Session{
+		UserID:     ls.User.ID,
+		Device:     device,
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	err := ls.Storage.AddSession(ls.Ctx, &session)
+	if err != nil {
+		return session, err
+	}
+	log.Printf("For user %d, created session %d from %s\n", ls.User.ID, session.ID, ip)
+	ls.recordSecurityEvent(dbconnector.SecurityEvent{
+		UserID:    ls.User.ID,
+		Login:     ls.User.Email,
+		Type:      SecurityEventSessionCreated,
+		Success:   true,
+		IP:        ip,
+		UserAgent: device,
+	})
+
+	return session, nil
+}
+
+// ValidateSessionLogic проверяет, что сессия из токена существует, принадлежит пользователю и не отозвана
+func (ls *LogicSystem) ValidateSessionLogic(claims TokenClaims) (dbconnector.Session, error) {
+	session, err := ls.Storage.GetSessionByID(ls.Ctx, claims.SessionID)
+	if err != nil {
+		return session, errors.ErrSessionNotFound
+	}
+
+	if session.UserID != claims.UserID {
+		return session, errors.ErrSessionNotFound
+	}
+	if session.RevokedAt != nil {
+		return session, errors.ErrSessionRevoked
+	}
+	now := time.Now()
+	if !now.Before(session.ExpiresAt) {
+		return session, errors.ErrTokenExpired
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		// не смогли обновить время - не повод отказывать пользователю
+		if err := ls.Storage.TouchSession(ls.Ctx, session.ID, now); err != nil {
+			log.Printf("can't touch session %d: %v\n", session.ID, err)
+		}
+		session.LastSeenAt = now
+	}
+
+	return session, nil
+}
+
+func (ls *LogicSystem) GetSessionsLogic(currentSessionID uint) ([]models.SessionResponse, error) {
+	sessions, err := ls.Storage.GetActiveSessionsByUserID(ls.Ctx, ls.User.ID)
+	if err != nil {
+		return []models.SessionResponse{}, err
+	}
+
+	sessionResponses := make([]models.SessionResponse, len(sessions))
+	for i, session := range sessions {
+		sessionResponses[i] = models.SessionResponse{
+			ID:         session.ID,
+			Device:     session.Device,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    session.ID == currentSessionID,
+		}
+	}
+
+	return sessionResponses, nil
+}
+
+func (ls *LogicSystem) RevokeSessionLogic(sessionID uint) (int /*httpCode*/, error) {
+	err := ls.Storage.RevokeSession(ls.Ctx, sessionID, ls.User.ID)
+	if err == errors.ErrSessionNotFound {
+		return http.StatusNotFound, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	log.Printf("For user %d, revoked session %d\n", ls.User.ID, sessionID)
+	return http.StatusOK, nil
+}
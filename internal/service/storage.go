@@ -2,22 +2,50 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"github.com/theheadmen/goDipl2/internal/dbconnector"
 )
 
 type Storage interface {
 	GetUserByEmail(ctx context.Context, email string) (dbconnector.User, error)
+	GetUserByOIDCSubject(ctx context.Context, subject string) (dbconnector.User, error)
 	GetUserByUserID(ctx context.Context, userID uint) (dbconnector.User, error)
 	GetOrderByNumber(ctx context.Context, orderNumber string) (bool, dbconnector.Order, error)
 	AddOrder(ctx context.Context, newOrder *dbconnector.Order) error
-	UpdateOrder(ctx context.Context, updOrder *dbconnector.Order) error
 	AddUser(ctx context.Context, newUser *dbconnector.User) error
-	UpdateUser(ctx context.Context, updUser *dbconnector.User) error
+	UpdateUserFields(ctx context.Context, updUser *dbconnector.User, fields ...string) error
 	DeleteUser(ctx context.Context, updUser *dbconnector.User) error
 	GetOrdersByUserID(ctx context.Context, userID uint) ([]dbconnector.Order, error)
 	AddWithdrawal(ctx context.Context, withdrawal *dbconnector.Withdrawal) error
 	GetAddWithdrawalsByUserID(ctx context.Context, userID uint) ([]dbconnector.Withdrawal, error)
-	GetWaitingOrders(ctx context.Context) ([]dbconnector.Order, error)
+	ScheduleOrderCheck(ctx context.Context, order *dbconnector.Order) error
+	ClaimDueOrders(ctx context.Context, owner string, now time.Time, leaseFor time.Duration, limit int) ([]dbconnector.Order, error)
+	ApplyAccrualResult(ctx context.Context, order *dbconnector.Order, owner string) (bool, error)
+	ClaimOrder(ctx context.Context, number string, owner string, now time.Time, leaseFor time.Duration) (dbconnector.Order, bool, error)
+	ReleaseOrders(ctx context.Context, owner string) error
 	WithdrawalTransaction(ctx context.Context, order *dbconnector.Order, withdrawal *dbconnector.Withdrawal, user *dbconnector.User, userEmail string, requestedSum float64) error
+	AddSession(ctx context.Context, session *dbconnector.Session) error
+	GetSessionByID(ctx context.Context, sessionID uint) (dbconnector.Session, error)
+	GetActiveSessionsByUserID(ctx context.Context, userID uint) ([]dbconnector.Session, error)
+	TouchSession(ctx context.Context, sessionID uint, lastSeenAt time.Time) error
+	RevokeSession(ctx context.Context, sessionID uint, userID uint) error
+	RevokeUserSessions(ctx context.Context, userID uint, exceptSessionID uint) error
+	AddOneTimeToken(ctx context.Context, token *dbconnector.OneTimeToken) error
+	GetOneTimeToken(ctx context.Context, purpose string, tokenHash string) (dbconnector.OneTimeToken, error)
+	UseOneTimeToken(ctx context.Context, purpose string, tokenHash string) (dbconnector.OneTimeToken, error)
+	GetLoginThrottles(ctx context.Context, keys []string) ([]dbconnector.LoginThrottle, error)
+	AddLoginFailure(ctx context.Context, key string, now time.Time, resetBefore time.Time) (dbconnector.LoginThrottle, error)
+	ResetLoginFailures(ctx context.Context, key string) error
+	UseTOTPCounter(ctx context.Context, userID uint, counter int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uint, codeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userID uint, codeHash string) error
+	AddAPIKey(ctx context.Context, apiKey *dbconnector.APIKey) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (dbconnector.APIKey, error)
+	GetAPIKeysByUserID(ctx context.Context, userID uint) ([]dbconnector.APIKey, error)
+	TouchAPIKey(ctx context.Context, keyID uint, lastUsedAt time.Time) error
+	RevokeAPIKey(ctx context.Context, keyID uint, userID uint) error
+	AddSecurityEvent(ctx context.Context, event *dbconnector.SecurityEvent) error
+	GetSecurityEventsByUserID(ctx context.Context, userID uint, limit int, offset int) ([]dbconnector.SecurityEvent, error)
+	PurgeUserData(ctx context.Context, user *dbconnector.User, loginEmail string, throttleKey string) error
 }
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+)
+
+// mfaTokenTTL сколько есть времени на ввод кода второго фактора после пароля
+const mfaTokenTTL = 5 * time.Minute
+
+const mfaTokenKind = "mfa"
+
+// TokenClaims то, что мы кладем внутрь токена сессии
+type TokenClaims struct {
+	UserID    uint   `json:"uid"`
+	SessionID uint   `json:"sid"`
+	ExpiresAt int64  `json:"exp"`
+	Kind      string `json:"typ,omitempty"`
+}
+
+// TokenManager выпускает и проверяет токены сессии вида payload.signature,
+// где payload это base64 от JSON с TokenClaims, а signature это HMAC-SHA256 от payload
+type TokenManager struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewTokenManager(secret string, ttl time.Duration) *TokenManager {
+	return &TokenManager{secret: []byte(secret), ttl: ttl}
+}
+
+func (tm *TokenManager) TTL() time.Duration {
+	return tm.ttl
+}
+
+// Issue выпускает новый токен для сессии пользователя, который живет ttl
+func (tm *TokenManager) Issue(userID uint, sessionID uint) (string, error) {
+	return tm.issue(TokenClaims{
+		UserID:    userID,
+		SessionID: sessionID,
+		ExpiresAt: time.Now().Add(tm.ttl).Unix(),
+	})
+}
+
+// IssueMFA выпускает короткоживущий токен "пароль уже проверен, ждем второй фактор".
+// Сессию по нему получить нельзя, только обменять вместе с кодом
+func (tm *TokenManager) IssueMFA(userID uint) (string, error) {
+	return tm.issue(TokenClaims{
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(mfaTokenTTL).Unix(),
+		Kind:      mfaTokenKind,
+	})
+}
+
+// Parse проверяет подпись и срок жизни токена сессии и возвращает его содержимое
+func (tm *TokenManager) Parse(token string) (TokenClaims, error) {
+	claims, err := tm.parse(token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Kind != "" {
+		return claims, errors.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// ParseMFA то же самое для токена второго фактора
+func (tm *TokenManager) ParseMFA(token string) (TokenClaims, error) {
+	claims, err := tm.parse(token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Kind != mfaTokenKind {
+		return claims, errors.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// CSRFToken токен защиты от CSRF, привязанный к сессии: подделать его без секрета нельзя,
+// а после отзыва сессии он становится бесполезен
+func (tm *TokenManager) CSRFToken(sessionID uint) string {
+	return tm.sign("csrf:" + strconv.FormatUint(uint64(sessionID), 10))
+}
+
+// CheckCSRF сверяет присланный клиентом CSRF токен с токеном сессии
+func (tm *TokenManager) CheckCSRF(sessionID uint, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(tm.CSRFToken(sessionID)))
+}
+
+func (tm *TokenManager) issue(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	return encodedPayload + "." + tm.sign(encodedPayload), nil
+}
+
+func (tm *TokenManager) parse(token string) (TokenClaims, error) {
+	var claims TokenClaims
+
+	encodedPayload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return claims, errors.ErrInvalidToken
+	}
+	// сравниваем подписи за постоянное время, чтобы не подсказывать атакующему
+	if !hmac.Equal([]byte(signature), []byte(tm.sign(encodedPayload))) {
+		return claims, errors.ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return claims, errors.ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.ErrTokenExpired
+	}
+
+	return claims, nil
+}
+
+func (tm *TokenManager) sign(encodedPayload string) string {
+	mac := hmac.New(sha256.New, tm.secret)
+	mac.Write([]byte(encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
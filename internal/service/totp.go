@@ -0,0 +1,91 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Параметры TOTP по RFC 6238, такие понимает любое приложение-аутентификатор
+const (
+	totpIssuer = "Gophermart"
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// сколько соседних интервалов принимаем, чтобы пережить расхождение часов
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(raw), nil
+}
+
+// totpURI ссылка otpauth://, из нее приложение-аутентификатор заводит аккаунт (обычно через QR код)
+func totpURI(account string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation из RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// TOTPCode код, который приложение-аутентификатор покажет в момент t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, totpCounter(t))
+}
+
+// matchTOTP ищет интервал, для которого подходит код, и возвращает его номер.
+// Номер нужен, чтобы один и тот же код нельзя было использовать дважды
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"crypto/rand"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/theheadmen/goDipl2/internal/errors"
+	"github.com/theheadmen/goDipl2/internal/models"
+)
+
+const recoveryCodesCount = 10
+
+// EnrollTOTPLogic генерирует новый секрет TOTP для ls.User. Второй фактор включится только после ConfirmTOTPLogic
+func (ls *LogicSystem) EnrollTOTPLogic() (models.TOTPEnrollResponse, error) {
+	if ls.User.TOTPEnabled {
+		return models.TOTPEnrollResponse{}, errors.ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return models.TOTPEnrollResponse{}, err
+	}
+	ls.User.TOTPSecret = secret
+
+	// ls.User загружен в начале запроса, поэтому сохраняем только секрет
+	err = ls.Storage.UpdateUserFields(ls.Ctx, ls.User, "TOTPSecret")
+	if err != nil {
+		return models.TOTPEnrollResponse{}, err
+	}
+	log.Printf("For user %d, started TOTP enrollment\n", ls.User.ID)
+
+	return models.TOTPEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: totpURI(ls.User.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTPLogic включает второй фактор, если пользователь прислал верный первый код, и выдает резервные коды
+func (ls *LogicSystem) ConfirmTOTPLogic(code string) (models.TOTPConfirmResponse, error) {
+	if ls.User.TOTPEnabled {
+		return models.TOTPConfirmResponse{}, errors.ErrTOTPAlreadyEnabled
+	}
+	if ls.User.TOTPSecret == "" {
+		return models.TOTPConfirmResponse{}, errors.ErrTOTPNotEnrolled
+	}
+
+	err := ls.checkTOTPCode(code)
+	if err != nil {
+		return models.TOTPConfirmResponse{}, err
+	}
+
+	recoveryCodes, err := ls.regenerateRecoveryCodes()
+	if err != nil {
+		return models.TOTPConfirmResponse{}, err
+	}
+
+	// счетчик мог обновиться в checkTOTPCode, поэтому перечитываем пользователя перед сохранением
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, ls.User.ID)
+	if err != nil {
+		return models.TOTPConfirmResponse{}, err
+	}
+	user.TOTPEnabled = true
+	err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "TOTPEnabled")
+	if err != nil {
+		return models.TOTPConfirmResponse{}, err
+	}
+	ls.User = &user
+	log.Printf("For user %d, TOTP enabled\n", ls.User.ID)
+
+	return models.TOTPConfirmResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTOTPLogic выключает второй фактор, для этого нужен действующий код или резервный код
+func (ls *LogicSystem) DisableTOTPLogic(code string) error {
+	if !ls.User.TOTPEnabled {
+		return errors.ErrTOTPNotEnrolled
+	}
+
+	err := ls.checkSecondFactor(code)
+	if err != nil {
+		return err
+	}
+
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, ls.User.ID)
+	if err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	err = ls.Storage.UpdateUserFields(ls.Ctx, &user, "TOTPEnabled", "TOTPSecret")
+	if err != nil {
+		return err
+	}
+	ls.User = &user
+
+	err = ls.Storage.ReplaceRecoveryCodes(ls.Ctx, user.ID, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("For user %d, TOTP disabled\n", ls.User.ID)
+
+	return nil
+}
+
+// LoginMFALogic второй шаг входа: по токену после пароля и коду второго фактора находим пользователя.
+// Подбор кода ограничен той же политикой, что и подбор пароля
+func (ls *LogicSystem) LoginMFALogic(claims TokenClaims, code string, lockout LockoutPolicy, clientIP string, userAgent string) (int /*responce code*/, error) {
+	user, err := ls.Storage.GetUserByUserID(ls.Ctx, claims.UserID)
+	if err != nil {
+		return http.StatusUnauthorized, errors.ErrInvalidToken
+	}
+	ls.User = &user
+
+	err = ls.checkLockout(lockout, clientIP)
+	if err != nil {
+		if _, ok := err.(*errors.LockedOutError); ok {
+			ls.recordLoginAttempt(user.ID, false, "locked out", clientIP, userAgent)
+			return http.StatusTooManyRequests, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	err = ls.checkSecondFactor(code)
+	if err == errors.ErrInvalidTOTPCode {
+		log.Printf("For user %d, invalid two-factor code\n", user.ID)
+		ls.registerLoginFailure(lockout, clientIP)
+		ls.recordLoginAttempt(user.ID, false, "invalid two-factor code", clientIP, userAgent)
+		return http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	ls.recordLoginAttempt(user.ID, true, "two-factor code", clientIP, userAgent)
+
+	err = ls.Storage.ResetLoginFailures(ls.Ctx, loginThrottleKey(user.Email))
+	if err != nil {
+		log.Printf("can't reset login failures for %s: %v\n", user.Email, err)
+	}
+
+	return 0, nil
+}
+
+// checkTOTPCode принимает только код из приложения, один код нельзя использовать дважды
+func (ls *LogicSystem) checkTOTPCode(code string) error {
+	counter, ok := matchTOTP(ls.User.TOTPSecret, code, time.Now())
+	if !ok {
+		return errors.ErrInvalidTOTPCode
+	}
+	return ls.Storage.UseTOTPCounter(ls.Ctx, ls.User.ID, counter)
+}
+
+// checkSecondFactor принимает код из приложения или один из резервных кодов
+func (ls *LogicSystem) checkSecondFactor(code string) error {
+	if !ls.User.TOTPEnabled {
+		return errors.ErrTOTPNotEnrolled
+	}
+
+	if len(strings.TrimSpace(code)) == totpDigits {
+		return ls.checkTOTPCode(code)
+	}
+
+	err := ls.Storage.UseRecoveryCode(ls.Ctx, ls.User.ID, hashToken(normalizeRecoveryCode(code)))
+	if err == nil {
+		log.Printf("For user %d, used recovery code\n", ls.User.ID)
+	}
+	return err
+}
+
+func (ls *LogicSystem) regenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	codeHashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw)) // 8 символов
+		codes[i] = code[:4] + "-" + code[4:]
+		codeHashes[i] = hashToken(code)
+	}
+
+	err := ls.Storage.ReplaceRecoveryCodes(ls.Ctx, ls.User.ID, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}